@@ -0,0 +1,73 @@
+package nds
+
+import (
+	"time"
+
+	"appengine"
+)
+
+// Cache is the interface nds uses to cache entities. The default is Memcache,
+// which uses the App Engine memcache service. Other implementations can be
+// used by calling SetCache.
+//
+// nds relies on the following semantics to keep the cache strongly
+// consistent:
+//
+// AddMulti must only add an item if its key is not already in use.
+//
+// GetMulti must return only the items that exist. Each returned item should
+// carry whatever information CompareAndSwapMulti needs, using Item.SetCASInfo.
+//
+// CompareAndSwapMulti must only replace an item previously returned by
+// GetMulti if it has not been modified or evicted since it was got.
+//
+// SetMulti must unconditionally write the items and DeleteMulti must
+// unconditionally remove them. DeleteMulti must report keys that are not in
+// the cache as memcache.ErrCacheMiss, which Invalidate ignores, in an
+// appengine.MultiError.
+//
+// Per item failures should be returned as an appengine.MultiError. Methods may
+// be called with no keys or items and should return quickly in that case.
+type Cache interface {
+	AddMulti(c appengine.Context, items []*Item) error
+	CompareAndSwapMulti(c appengine.Context, items []*Item) error
+	DeleteMulti(c appengine.Context, keys []string) error
+	GetMulti(c appengine.Context, keys []string) (map[string]*Item, error)
+	SetMulti(c appengine.Context, items []*Item) error
+}
+
+// Item is the unit of Cache get and set operations.
+type Item struct {
+	// Key is the Item's key (250 bytes maximum).
+	Key string
+	// Value is the Item's value.
+	Value []byte
+	// Flags are server-opaque flags whose semantics are entirely up to nds.
+	Flags uint32
+	// Expiration is the maximum duration that the item will stay in the
+	// cache. The zero value means the Item has no expiration time.
+	Expiration time.Duration
+
+	casInfo interface{}
+}
+
+// SetCASInfo stores the information a Cache needs to perform a
+// compare-and-swap operation on the item. It is intended to be called by
+// Cache implementations from GetMulti.
+func (i *Item) SetCASInfo(info interface{}) {
+	i.casInfo = info
+}
+
+// GetCASInfo returns the information previously stored with SetCASInfo.
+func (i *Item) GetCASInfo() interface{} {
+	return i.casInfo
+}
+
+var cache Cache = Memcache{}
+
+// SetCache sets the Cache used by nds. It is not safe to call SetCache
+// concurrently with other nds functions so it should be called once during
+// app initialisation.
+func SetCache(c Cache) {
+	cache = c
+}
@@ -0,0 +1,164 @@
+package nds
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"appengine/datastore"
+)
+
+// Options configures a Client. The zero value of each field selects its
+// default.
+type Options struct {
+	// LockTime is the maximum length of time a cache lock is held for. It
+	// must be longer than any datastore call can take. The default is 32
+	// seconds.
+	LockTime time.Duration
+
+	// LockWait is the maximum length of time a get waits for an entity that
+	// another request has locked to be cached before reading it from the
+	// datastore. The cache is polled with an exponential backoff. The
+	// default of zero reads the datastore straight away. SetLockWait only
+	// changes the wait of the package level functions.
+	LockWait time.Duration
+
+	// Prefix is prepended to every cache key. Clients with different
+	// prefixes never share cached entities. Puts, deletes and the Invalidate
+	// functions only remove the entities cached under their Client's prefix,
+	// so an entity written through one prefix stays stale under every other
+	// prefix until it expires. Entities of a kind must therefore only be
+	// cached under one prefix. The default is "NDS2:".
+	Prefix string
+
+	// GetMultiLimit, PutMultiLimit and DeleteMultiLimit are the maximum
+	// number of entities sent in a single datastore call. Larger batches are
+	// split into several concurrent calls. They default to, and cannot be
+	// greater than, the datastore limits of 1000, 500 and 500.
+	GetMultiLimit    int
+	PutMultiLimit    int
+	DeleteMultiLimit int
+
+	// Marshal and Unmarshal convert entities to and from the values stored
+	// in the cache. Either both or neither must be set. The default is a
+	// compact binary codec.
+	Marshal   func(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal func(data []byte, pl *datastore.PropertyList) error
+
+	// WriteThrough makes puts replace the lock on each entity with the
+	// entity, as described by SetWriteThrough.
+	WriteThrough bool
+
+	// CacheNewEntities makes puts cache the entities they put with
+	// incomplete keys, as described by SetCacheNewEntities.
+	CacheNewEntities bool
+
+	// CompressionMinSize is the marshaled size in bytes from which cached
+	// entities are compressed, as described by SetCompression. The default
+	// of zero disables compression.
+	CompressionMinSize int
+
+	// KindPolicies holds the caching Policy of each kind, as described by
+	// SetKindPolicy. Kinds that are not in the map use the zero value
+	// Policy. NewClient copies the map.
+	KindPolicies map[string]Policy
+}
+
+// Client gets, puts and deletes entities using its own Options. The package
+// level functions use a Client with the default Options.
+//
+// All clients share the cache set with SetCache, the SetLegacyCache setting
+// and the stats. The other package level settings, such as SetKindPolicy, only
+// change the Options of the package level functions.
+type Client struct {
+	opts Options
+
+	// policiesMutex guards opts.KindPolicies, which SetKindPolicy changes
+	// for the default client.
+	policiesMutex sync.RWMutex
+}
+
+// defaultClient is used by the package level functions.
+var defaultClient = &Client{}
+
+// NewClient returns a Client that uses opts.
+func NewClient(opts Options) (*Client, error) {
+	if opts.LockTime < 0 {
+		return nil, errors.New("nds: negative LockTime")
+	}
+	if opts.LockWait < 0 {
+		return nil, errors.New("nds: negative LockWait")
+	}
+	if opts.GetMultiLimit < 0 || opts.GetMultiLimit > getMultiLimit {
+		return nil, errors.New("nds: invalid GetMultiLimit")
+	}
+	if opts.PutMultiLimit < 0 || opts.PutMultiLimit > putMultiLimit {
+		return nil, errors.New("nds: invalid PutMultiLimit")
+	}
+	if opts.DeleteMultiLimit < 0 || opts.DeleteMultiLimit > deleteMultiLimit {
+		return nil, errors.New("nds: invalid DeleteMultiLimit")
+	}
+	if (opts.Marshal == nil) != (opts.Unmarshal == nil) {
+		return nil, errors.New("nds: Marshal and Unmarshal must both be set")
+	}
+	if opts.CompressionMinSize < 0 {
+		return nil, errors.New("nds: negative CompressionMinSize")
+	}
+
+	policies := make(map[string]Policy, len(opts.KindPolicies))
+	for kind, p := range opts.KindPolicies {
+		policies[kind] = p
+	}
+	opts.KindPolicies = policies
+
+	return &Client{opts: opts}, nil
+}
+
+func (cl *Client) lockTime() time.Duration {
+	if cl.opts.LockTime == 0 {
+		return memcacheLockTime
+	}
+	return cl.opts.LockTime
+}
+
+func (cl *Client) prefix() string {
+	if cl.opts.Prefix == "" {
+		return memcachePrefix
+	}
+	return cl.opts.Prefix
+}
+
+func (cl *Client) getMultiLimit() int {
+	if cl.opts.GetMultiLimit == 0 {
+		return getMultiLimit
+	}
+	return cl.opts.GetMultiLimit
+}
+
+func (cl *Client) putMultiLimit() int {
+	if cl.opts.PutMultiLimit == 0 {
+		return putMultiLimit
+	}
+	return cl.opts.PutMultiLimit
+}
+
+func (cl *Client) deleteMultiLimit() int {
+	if cl.opts.DeleteMultiLimit == 0 {
+		return deleteMultiLimit
+	}
+	return cl.opts.DeleteMultiLimit
+}
+
+func (cl *Client) marshal(pl datastore.PropertyList) ([]byte, error) {
+	if cl.opts.Marshal == nil {
+		return marshal(pl)
+	}
+	return cl.opts.Marshal(pl)
+}
+
+func (cl *Client) unmarshal(data []byte, pl *datastore.PropertyList) error {
+	if cl.opts.Unmarshal == nil {
+		return unmarshal(data, pl)
+	}
+	return cl.opts.Unmarshal(data, pl)
+}
@@ -0,0 +1,282 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// codecMarker is the first byte of every PropertyList encoded with the binary
+// codec so that data in any other format is rejected.
+const codecMarker byte = 0
+
+// codecVersion is the version of the binary codec. It must be incremented
+// whenever the encoding changes so that items encoded by other versions are
+// rejected rather than decoded incorrectly.
+const codecVersion byte = 1
+
+const (
+	propertyNoIndex byte = 1 << iota
+	propertyMultiple
+)
+
+const (
+	nilType byte = iota
+	int64Type
+	boolType
+	stringType
+	float64Type
+	keyType
+	timeType
+	blobKeyType
+	geoPointType
+	bytesType
+	byteStringType
+)
+
+var errCodecShortBuffer = errors.New("nds: codec buffer too short")
+
+// encodePropertyList encodes pl with the binary codec. It supports every
+// value type that can be stored in the datastore.
+func encodePropertyList(pl datastore.PropertyList) ([]byte, error) {
+	b := make([]byte, 0, 64*len(pl))
+	b = append(b, codecMarker, codecVersion)
+	b = appendUvarint(b, uint64(len(pl)))
+
+	for _, p := range pl {
+		b = appendBytes(b, []byte(p.Name))
+
+		var flags byte
+		if p.NoIndex {
+			flags |= propertyNoIndex
+		}
+		if p.Multiple {
+			flags |= propertyMultiple
+		}
+		b = append(b, flags)
+
+		switch v := p.Value.(type) {
+		case nil:
+			b = append(b, nilType)
+		case int64:
+			b = append(b, int64Type)
+			b = appendVarint(b, v)
+		case bool:
+			b = append(b, boolType)
+			if v {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case string:
+			b = append(b, stringType)
+			b = appendBytes(b, []byte(v))
+		case float64:
+			b = append(b, float64Type)
+			b = appendFloat64(b, v)
+		case *datastore.Key:
+			b = append(b, keyType)
+			if v == nil {
+				b = appendBytes(b, nil)
+			} else {
+				b = appendBytes(b, []byte(v.Encode()))
+			}
+		case time.Time:
+			b = append(b, timeType)
+			b = appendVarint(b, v.Unix())
+			b = appendUvarint(b, uint64(v.Nanosecond()))
+		case appengine.BlobKey:
+			b = append(b, blobKeyType)
+			b = appendBytes(b, []byte(v))
+		case appengine.GeoPoint:
+			b = append(b, geoPointType)
+			b = appendFloat64(b, v.Lat)
+			b = appendFloat64(b, v.Lng)
+		case []byte:
+			b = append(b, bytesType)
+			b = appendBytes(b, v)
+		case datastore.ByteString:
+			b = append(b, byteStringType)
+			b = appendBytes(b, v)
+		default:
+			return nil, fmt.Errorf("nds: unsupported property value type %T",
+				p.Value)
+		}
+	}
+	return b, nil
+}
+
+// decodePropertyList decodes data encoded with encodePropertyList and
+// appends the properties to pl.
+func decodePropertyList(data []byte, pl *datastore.PropertyList) error {
+	if len(data) < 2 || data[0] != codecMarker {
+		return errors.New("nds: not binary codec data")
+	}
+	if data[1] != codecVersion {
+		return fmt.Errorf("nds: unknown codec version %d", data[1])
+	}
+
+	d := decoder{data: data[2:]}
+	count := d.uvarint()
+	if d.err == nil && count > uint64(len(d.data)) {
+		return errCodecShortBuffer
+	}
+
+	props := make(datastore.PropertyList, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		p := datastore.Property{}
+		p.Name = string(d.bytes())
+
+		flags := d.byte()
+		p.NoIndex = flags&propertyNoIndex != 0
+		p.Multiple = flags&propertyMultiple != 0
+
+		switch t := d.byte(); t {
+		case nilType:
+		case int64Type:
+			p.Value = d.varint()
+		case boolType:
+			p.Value = d.byte() != 0
+		case stringType:
+			p.Value = string(d.bytes())
+		case float64Type:
+			p.Value = d.float64()
+		case keyType:
+			var key *datastore.Key
+			if encoded := d.bytes(); len(encoded) > 0 && d.err == nil {
+				if key, d.err = datastore.DecodeKey(string(encoded)); d.err != nil {
+					break
+				}
+			}
+			p.Value = key
+		case timeType:
+			sec := d.varint()
+			nsec := d.uvarint()
+			p.Value = time.Unix(sec, int64(nsec)).UTC()
+		case blobKeyType:
+			p.Value = appengine.BlobKey(d.bytes())
+		case geoPointType:
+			p.Value = appengine.GeoPoint{Lat: d.float64(), Lng: d.float64()}
+		case bytesType:
+			p.Value = d.bytes()
+		case byteStringType:
+			p.Value = datastore.ByteString(d.bytes())
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("nds: unknown property value type %d", t)
+			}
+		}
+		props = append(props, p)
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) != 0 {
+		return errors.New("nds: unexpected trailing codec data")
+	}
+	*pl = append(*pl, props...)
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendFloat64(b []byte, v float64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decoder reads values written by the append functions. Once an error has
+// occurred all further reads return zero values and the first error is kept
+// in err.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 1 {
+		d.err = errCodecShortBuffer
+		return 0
+	}
+	v := d.data[0]
+	d.data = d.data[1:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errCodecShortBuffer
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errCodecShortBuffer
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) float64() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 8 {
+		d.err = errCodecShortBuffer
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v
+}
+
+// bytes returns a copy of the next length prefixed byte slice.
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.err = errCodecShortBuffer
+		return nil
+	}
+	v := make([]byte, n)
+	copy(v, d.data)
+	d.data = d.data[n:]
+	return v
+}
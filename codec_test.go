@@ -0,0 +1,152 @@
+package nds_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+)
+
+func codecPropertyList(c appengine.Context) datastore.PropertyList {
+	parent := datastore.NewKey(c, "Parent", "name", 0, nil)
+	return datastore.PropertyList{
+		datastore.Property{Name: "Nil"},
+		datastore.Property{Name: "Int", Value: int64(-12345)},
+		datastore.Property{Name: "Bool", Value: true, NoIndex: true},
+		datastore.Property{Name: "String", Value: "value", Multiple: true},
+		datastore.Property{Name: "String", Value: "other", Multiple: true},
+		datastore.Property{Name: "Float", Value: 3.25},
+		datastore.Property{Name: "Key",
+			Value: datastore.NewKey(c, "Child", "", 7, parent)},
+		datastore.Property{Name: "NilKey", Value: (*datastore.Key)(nil)},
+		datastore.Property{Name: "Time",
+			Value: time.Unix(1234567890, 123456789)},
+		datastore.Property{Name: "BlobKey", Value: appengine.BlobKey("blob"),
+			NoIndex: true},
+		datastore.Property{Name: "GeoPoint",
+			Value: appengine.GeoPoint{Lat: 1.5, Lng: -2.5}},
+		datastore.Property{Name: "Bytes", Value: []byte{0, 1, 2},
+			NoIndex: true},
+		datastore.Property{Name: "ByteString",
+			Value: datastore.ByteString("bytes")},
+	}
+}
+
+func checkCodecPropertyList(t *testing.T,
+	expected, actual datastore.PropertyList) {
+
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d properties, got %d", len(expected), len(actual))
+	}
+	for i, e := range expected {
+		a := actual[i]
+		if e.Name != a.Name || e.NoIndex != a.NoIndex ||
+			e.Multiple != a.Multiple {
+			t.Fatalf("property %d: expected %+v, got %+v", i, e, a)
+		}
+
+		switch ev := e.Value.(type) {
+		case *datastore.Key:
+			av, ok := a.Value.(*datastore.Key)
+			if !ok {
+				t.Fatalf("property %d: expected key, got %T", i, a.Value)
+			}
+			if (ev == nil) != (av == nil) || (ev != nil && !ev.Equal(av)) {
+				t.Fatalf("property %d: expected %v, got %v", i, ev, av)
+			}
+		case time.Time:
+			av, ok := a.Value.(time.Time)
+			if !ok || !ev.Equal(av) {
+				t.Fatalf("property %d: expected %v, got %v", i, ev, a.Value)
+			}
+		default:
+			if !reflect.DeepEqual(e.Value, a.Value) {
+				t.Fatalf("property %d: expected %#v, got %#v",
+					i, e.Value, a.Value)
+			}
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pl := codecPropertyList(c)
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkCodecPropertyList(t, pl, decoded)
+
+	// Times are decoded in UTC like those loaded from the datastore.
+	for _, p := range decoded {
+		if tm, ok := p.Value.(time.Time); ok && tm.Location() != time.UTC {
+			t.Fatal("expected UTC time", tm.Location())
+		}
+	}
+
+	// Empty property lists are valid entities.
+	data, err = nds.MarshalPropertyList(datastore.PropertyList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 0 {
+		t.Fatal("expected no properties")
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data, err := nds.MarshalPropertyList(codecPropertyList(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data in other formats.
+	pl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList([]byte{0x1f, 0xff}, &pl); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Unknown version.
+	unknown := append([]byte{}, data...)
+	unknown[1] = 0xff
+	pl = datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(unknown, &pl); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Truncated data.
+	for i := 1; i < len(data); i++ {
+		pl := datastore.PropertyList{}
+		if err := nds.UnmarshalPropertyList(data[:i], &pl); err == nil {
+			t.Fatal("expected error for length", i)
+		}
+		if len(pl) != 0 {
+			t.Fatal("expected no properties for length", i)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package nds_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestCompression(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		Text string `datastore:",noindex"`
+	}
+
+	nds.SetCompression(1)
+	defer nds.SetCompression(0)
+
+	text := strings.Repeat("compressible ", 1000)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	entities := []testEntity{testEntity{text}, testEntity{"a"}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := memcache.Get(c, nds.CreateMemcacheKey(c, keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.CompressedEntityItem {
+		t.Fatal("expected compressed entity item", item.Flags)
+	}
+	if len(item.Value) >= len(text) {
+		t.Fatal("expected compressed value", len(item.Value))
+	}
+
+	// Entities that don't compress are stored uncompressed.
+	item, err = memcache.Get(c, nds.CreateMemcacheKey(c, keys[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item", item.Flags)
+	}
+
+	// Compressed entities can be read even if compression is disabled.
+	nds.SetCompression(0)
+
+	nds.SetDatastoreGetMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		return errors.New("expected entities from cache")
+	})
+	respEntities := make([]testEntity, 2)
+	err = nds.GetMulti(c, keys, respEntities)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respEntities[0].Text != text {
+		t.Fatal("incorrect text")
+	}
+	if respEntities[1].Text != "a" {
+		t.Fatal("incorrect text", respEntities[1].Text)
+	}
+}
+
+func TestCompressionCorruptItem(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(c, key),
+		Flags: nds.CompressedEntityItem,
+		Value: []byte("not compressed"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt items fall back to the datastore.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+}
@@ -0,0 +1,137 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestNewContext(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.NewContext(c)
+	if nds.NewContext(lc) != lc {
+		t.Fatal("expected the same local context")
+	}
+
+	key := datastore.NewKey(lc, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	getMultiCount := 0
+	nds.SetMemcacheGetMulti(func(c appengine.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		if len(keys) > 0 {
+			getMultiCount++
+		}
+		return nds.ZeroMemcacheGetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(nds.ZeroMemcacheGetMulti)
+
+	// Get from datastore.
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	// Get from local cache.
+	getMultiCount = 0
+	te = &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+	if getMultiCount != 0 {
+		t.Fatal("expected no memcache calls", getMultiCount)
+	}
+
+	// Put should evict the local cache.
+	if _, err := nds.Put(lc, key, &testEntity{64}); err != nil {
+		t.Fatal(err)
+	}
+	te = &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 64 {
+		t.Fatal("te.IntVal != 64", te.IntVal)
+	}
+
+	// Delete should evict the local cache.
+	if err := nds.Delete(lc, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(lc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// Missing entities are cached locally too.
+	getMultiCount = 0
+	if err := nds.Get(lc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	if getMultiCount != 0 {
+		t.Fatal("expected no memcache calls", getMultiCount)
+	}
+}
+
+func TestNewContextTransaction(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.NewContext(c)
+
+	key := datastore.NewKey(lc, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime local cache.
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.RunInTransaction(lc, func(tc appengine.Context) error {
+		if nds.NewContext(tc) != tc {
+			t.Fatal("expected transaction context")
+		}
+		_, err := nds.Put(tc, key, &testEntity{64})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 64 {
+		t.Fatal("te.IntVal != 64", te.IntVal)
+	}
+}
@@ -1,29 +1,116 @@
 package nds
 
 import (
+	"sync"
+
 	"appengine"
 	"appengine/datastore"
-	"appengine/memcache"
 )
 
+// deleteMultiLimit is the App Engine datastore limit for the maximum number
+// of entities that can be deleted by datastore.DeleteMulti at once.
+// nds.DeleteMulti increases this limit by performing as many
+// datastore.DeleteMulti as required concurrently and collating the results.
+const deleteMultiLimit = 500
+
 // DeleteMulti works just like datastore.DeleteMulti except it maintains
-// cache consistency with other NDS methods.
+// cache consistency with other NDS methods. It also removes the API limit of
+// 500 entities per request by calling the datastore as many times as required
+// to delete all the keys. It does this efficiently and concurrently.
 func DeleteMulti(c appengine.Context, keys []*datastore.Key) error {
-	return deleteMulti(c, keys)
+	return defaultClient.DeleteMulti(c, keys)
+}
+
+// DeleteMulti works like the package level DeleteMulti using the Client's
+// Options.
+func (cl *Client) DeleteMulti(c appengine.Context,
+	keys []*datastore.Key) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	limit := cl.deleteMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
+	errs := make([]error, callCount)
+
+	wg := sync.WaitGroup{}
+	wg.Add(callCount)
+	for i := 0; i < callCount; i++ {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		index := i
+		keySlice := keys[lo:hi]
+
+		go func() {
+			errs[index] = cl.deleteMulti(c, keySlice)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	// Quick escape if all errors are nil.
+	errsNil := true
+	for _, err := range errs {
+		if err != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+
+	groupedErrs := make(appengine.MultiError, len(keys))
+	for i, err := range errs {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		if me, ok := err.(appengine.MultiError); ok {
+			copy(groupedErrs[lo:hi], me)
+		} else if err != nil {
+			return err
+		}
+	}
+	return groupedErrs
 }
 
 // Delete deletes the entity for the given key.
 func Delete(c appengine.Context, key *datastore.Key) error {
-	err := deleteMulti(c, []*datastore.Key{key})
+	return defaultClient.Delete(c, key)
+}
+
+// Delete works like the package level Delete using the Client's Options.
+func (cl *Client) Delete(c appengine.Context, key *datastore.Key) error {
+	err := cl.DeleteMulti(c, []*datastore.Key{key})
 	if me, ok := err.(appengine.MultiError); ok {
 		return me[0]
 	}
 	return err
 }
 
-func deleteMulti(c appengine.Context, keys []*datastore.Key) error {
+func (cl *Client) deleteMulti(c appengine.Context,
+	keys []*datastore.Key) error {
 
-	lockMemcacheItems := []*memcache.Item{}
+	// Entities are locked with the transaction's Client so that their
+	// cache keys match those it removes once it commits.
+	if txc, ok := transactionContext(c); ok && txc.client != cl {
+		return txc.client.deleteMulti(c, keys)
+	}
+
+	gens, err := cl.loadGenerations(c, keys)
+	if err != nil {
+		return err
+	}
+
+	lockKeys := []*datastore.Key{}
+	lockMemcacheKeys := []string{}
+	lockMemcacheItems := []*Item{}
 	for _, key := range keys {
 		// Worst case scenario is that we lock the entity for memcacheLockTime.
 		// datastore.Delete will raise the appropriate error.
@@ -31,22 +118,44 @@ func deleteMulti(c appengine.Context, keys []*datastore.Key) error {
 			continue
 		}
 
-		item := &memcache.Item{
-			Key:        createMemcacheKey(key),
+		item := &Item{
+			Key:        cl.createMemcacheKey(gens, key),
 			Flags:      lockItem,
 			Value:      itemLock(),
-			Expiration: memcacheLockTime,
+			Expiration: cl.lockTime(),
 		}
+		lockKeys = append(lockKeys, key)
 		lockMemcacheItems = append(lockMemcacheItems, item)
+		lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
 	}
 
 	// Make sure we can lock memcache with no errors before deleting.
 	if txc, ok := transactionContext(c); ok {
+		txc.Lock()
+		txc.lockKeys = append(txc.lockKeys, lockKeys...)
 		txc.lockMemcacheItems = append(txc.lockMemcacheItems,
 			lockMemcacheItems...)
-	} else if err := memcacheSetMulti(c, lockMemcacheItems); err != nil {
+		txc.Unlock()
+	} else if err := cache.SetMulti(c, append(cl.legacyLockItems(lockKeys),
+		lockMemcacheItems...)); err != nil {
 		return err
 	}
 
-	return datastoreDeleteMulti(c, keys)
+	err = datastoreDeleteMulti(c, keys)
+
+	if txc, ok := transactionContext(c); ok {
+		txc.delete(keys, err)
+	} else {
+		// Entities may have been cached under a new generation while they
+		// were being deleted. Those items were not locked so are removed.
+		changedKeys := cl.changedMemcacheKeys(c, lockKeys, lockMemcacheKeys)
+		if err := cache.DeleteMulti(c, changedKeys); err != nil {
+			c.Warningf("deleteMulti memcache.DeleteMulti %s", err)
+		}
+	}
+
+	if lc, ok := localCacheContext(c); ok {
+		lc.evict(cl.localCacheKeys(lockKeys))
+	}
+	return err
 }
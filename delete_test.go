@@ -150,3 +150,116 @@ func TestDeleteInTransaction(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDeleteMultiLimit(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		Val int
+	}
+
+	for _, count := range []int{499, 500, 501, 1200} {
+
+		keys := []*datastore.Key{}
+		entities := []testEntity{}
+		for i := 0; i < count; i++ {
+			keys = append(keys,
+				datastore.NewKey(c, "Test", "", int64(i+1), nil))
+			entities = append(entities, testEntity{i})
+		}
+
+		if _, err := nds.PutMulti(c, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime cache.
+		if err := nds.GetMulti(c, keys, make([]testEntity, count)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := nds.DeleteMulti(c, keys); err != nil {
+			t.Fatal(err)
+		}
+
+		err := nds.GetMulti(c, keys, make([]testEntity, count))
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		for _, e := range me {
+			if e != datastore.ErrNoSuchEntity {
+				t.Fatal("expected datastore.ErrNoSuchEntity", e)
+			}
+		}
+	}
+}
+
+func TestDeleteMultiLimitMultiError(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expectedErr := errors.New("expected error")
+
+	// Fail the delete of every key with an even IntID.
+	nds.SetDatastoreDeleteMulti(func(c appengine.Context,
+		keys []*datastore.Key) error {
+		me, isErr := make(appengine.MultiError, len(keys)), false
+		for i, key := range keys {
+			if key.IntID()%2 == 0 {
+				me[i] = expectedErr
+				isErr = true
+			}
+		}
+		if isErr {
+			return me
+		}
+		return datastore.DeleteMulti(c, keys)
+	})
+
+	defer func() {
+		nds.SetDatastoreDeleteMulti(datastore.DeleteMulti)
+	}()
+
+	count := 1001
+	keys := []*datastore.Key{}
+	for i := 0; i < count; i++ {
+		keys = append(keys, datastore.NewKey(c, "Test", "", int64(i+1), nil))
+	}
+
+	err = nds.DeleteMulti(c, keys)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if len(me) != count {
+		t.Fatal("incorrect length appengine.MultiError", len(me))
+	}
+	for i, e := range me {
+		if keys[i].IntID()%2 == 0 {
+			if e != expectedErr {
+				t.Fatalf("expected error at index %d", i)
+			}
+		} else if e != nil {
+			t.Fatalf("unexpected error at index %d: %s", i, e)
+		}
+	}
+}
+
+func TestDeleteMultiZeroKeys(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := nds.DeleteMulti(c, []*datastore.Key{}); err != nil {
+		t.Fatal(err)
+	}
+}
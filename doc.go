@@ -19,8 +19,116 @@ Package nds is used exactly the same way as appeninge/datastore. Ensure that
 you change all your datastore Get, Put, Delete and RunInTransaction function
 calls to use nds when converting your own code.
 
+Code that uses google.golang.org/appengine and context.Context should import
+github.com/qedus/nds/v2 instead. It has the same API, taking a context.Context
+in place of an appengine.Context. Only that package has the Datastore and
+Logger interfaces and the Memcached and Redis Caches, which can be used in
+place of the App Engine datastore, log and memcache services.
+
 If you mix appengine/datastore and nds API calls then you are liable to get
-stale cache.
+stale cache. If entities have to be changed without nds, call nds.Invalidate
+with their keys afterwards. nds.Warm can then be used to load them back into
+the cache. nds.InvalidateAll and nds.InvalidateNamespace invalidate every
+cached entity, or every cached entity in a namespace, without affecting any
+other memcache items.
+
+They work by changing a generation number that is part of every cache key.
+Generations are read from the cache whenever they are needed rather than kept
+by the app, so that an invalidation is seen at once by every request. This costs one extra cache call on each get
+that is not served by the local cache and two on each put and delete, one
+before and one after the datastore write.
+
+Queries
+
+Queries can be run with nds.GetAll and nds.Run. These execute the query keys
+only and then load the matching entities through nds.GetMulti, in batches
+for nds.Run, so that memcache is used where possible.
+
+Transactions
+
+Use nds.RunInTransaction in place of datastore.RunInTransaction. Functions
+registered with nds.OnCommit and nds.OnRollback are called once the
+transaction has made its final attempt, which makes them suitable for side
+effects such as enqueuing tasks.
+
+Context Cache
+
+Like Python ndb, an in process cache can be used in front of memcache for the
+lifetime of a request by wrapping the request context with nds.NewContext.
+Entities got more than once within the request will then only be loaded once.
+
+Kind Policies
+
+By default all entities are cached with no expiration time. Use
+nds.SetKindPolicy during app initialisation to stop caching entities of a kind
+or to give them an expiration time. Missing entities are cached too, so gets
+for keys that do not exist rarely read the datastore. A policy can give them
+their own expiration time or stop them from being cached.
+
+Compression
+
+Large entities can be compressed before they are cached by calling
+nds.SetCompression during app initialisation. This lets more entities fit in
+memcache and reduces network transfer.
+
+Entities are cached in a compact versioned binary format.
+
+Write-Through
+
+By default a put removes an entity from the cache so the next get reads it
+from the datastore. Calling nds.SetWriteThrough during app initialisation
+instead caches the entity as soon as it is put, unless another request has
+locked it in the meantime. Similarly, nds.SetCacheNewEntities caches entities
+put with incomplete keys under the keys allocated for them.
+
+Statistics
+
+nds.ReadStats returns counters, by entity kind, of cache hits, misses, locks
+and datastore reads made by the app instance. These can be used to monitor how
+effective the cache is.
+
+Clients
+
+The package level functions use the default options, which the package level
+settings such as nds.SetKindPolicy and nds.SetWriteThrough change. Use
+nds.NewClient to create a Client with its own cache lock time, cache key
+prefix, datastore batch limits, cache codec, kind policies, compression and
+write-through settings. Its methods work just like the package level functions
+and the package level settings do not apply to it.
+
+Clients with different prefixes do not share cached entities, and a put or
+delete through one Client only removes the entities cached under its own
+prefix. Entities of a kind should only be cached under one prefix, otherwise
+the other prefixes can serve stale entities until they expire.
+
+By default a get that finds an entity locked by another request reads it
+straight from the datastore. Setting Options.LockWait, or calling
+nds.SetLockWait for the package level functions, makes the get poll the cache
+for a while first so that a hot entity being updated does not send every
+concurrent request to the datastore.
+
+Cache Backends
+
+By default entities are cached in App Engine memcache. Any other cache that
+provides add, get, compare-and-swap, set and delete semantics can be used
+instead by implementing the Cache interface and passing it to SetCache.
+
+Upgrading
+
+Cache keys start with "NDS2:" since they began to include the generations used
+by nds.InvalidateAll and nds.InvalidateNamespace. Entities cached by earlier
+versions of nds under "NDS1:" keys are never read so the cache starts empty
+after upgrading.
+
+Call nds.SetLegacyCache(true) during app initialisation to deploy this version
+while an earlier version is still serving requests. Puts, deletes,
+transactions and nds.Invalidate then also lock and remove the "NDS1:" keys, so
+the earlier version never serves an entity that this version has changed. The
+earlier version does not lock the "NDS2:" keys, so gets read from the datastore
+instead of the cache until the call is removed. Once the earlier version has
+stopped, deploy a version without the call. It can serve requests alongside
+the version with the call as both lock the "NDS2:" keys. nds.InvalidateAll and
+nds.InvalidateNamespace do not affect the "NDS1:" keys.
 
 Converting Legacy Code
 
@@ -22,6 +22,12 @@ var (
 
 	NoneItem   = noneItem
 	EntityItem = entityItem
+	LockItem   = lockItem
+
+	CompressedEntityItem = compressedEntityItem
+	ManifestItem         = manifestItem
+
+	GlobalGenerationKey = defaultClient.globalGenerationKey()
 )
 
 func SetMemcacheAddMulti(f func(c appengine.Context,
@@ -53,6 +59,11 @@ func SetDatastorePutMulti(f func(c appengine.Context,
 	datastorePutMulti = f
 }
 
+func SetDatastoreDeleteMulti(f func(c appengine.Context,
+	keys []*datastore.Key) error) {
+	datastoreDeleteMulti = f
+}
+
 func SetDatastoreGetMulti(f func(c appengine.Context,
 	keys []*datastore.Key, vals interface{}) error) {
 	datastoreGetMulti = f
@@ -69,3 +80,35 @@ func SetUnmarshal(f func(data []byte, pl *datastore.PropertyList) error) {
 func SetValue(val reflect.Value, pl datastore.PropertyList) error {
 	return setValue(val, pl)
 }
+
+func ChunkKeys(memcacheKey string, manifestValue []byte) ([]string, error) {
+	m, err := decodeManifest(manifestValue)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, m.chunkCount)
+	for i := range keys {
+		keys[i] = m.chunkKey(memcacheKey, i)
+	}
+	return keys, nil
+}
+
+// CreateMemcacheKey returns the memcache key key is currently cached under.
+func CreateMemcacheKey(c appengine.Context, key *datastore.Key) string {
+	gens, err := defaultClient.loadGenerations(c, []*datastore.Key{key})
+	if err != nil {
+		panic(err)
+	}
+	return defaultClient.createMemcacheKey(gens, key)
+}
+
+// CreateMemcacheKey returns the memcache key the client currently caches key
+// under.
+func (cl *Client) CreateMemcacheKey(c appengine.Context,
+	key *datastore.Key) string {
+	gens, err := cl.loadGenerations(c, []*datastore.Key{key})
+	if err != nil {
+		panic(err)
+	}
+	return cl.createMemcacheKey(gens, key)
+}
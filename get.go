@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"reflect"
 	"sync"
+	"time"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/memcache"
 )
 
 // getMultiLimit is the App Engine datastore limit for the maximum number
@@ -16,6 +16,21 @@ import (
 // datastore.GetMulti as required concurrently and collating the results.
 const getMultiLimit = 1000
 
+// lockWaitDelay is how long a get first waits before polling the cache again
+// for an entity locked by another request. The delay doubles after each poll.
+const lockWaitDelay = 10 * time.Millisecond
+
+// SetLockWait sets how long the package level functions wait for entities
+// that other requests have locked, as described by Options.LockWait. Clients
+// use the LockWait of their own Options. d must not be negative. The default
+// of zero reads the datastore straight away.
+//
+// It is not safe to call SetLockWait concurrently with other nds functions so
+// it should be called once during app initialisation.
+func SetLockWait(d time.Duration) {
+	defaultClient.opts.LockWait = d
+}
+
 // GetMulti works similar to datastore.GetMulti except for two important
 // advantages:
 //
@@ -45,12 +60,19 @@ const getMultiLimit = 1000
 // type I, or some non-interface non-pointer type P such that P or *P implements
 // datastore.PropertyLoadSaver. If an []I, each element must be a valid dst for
 // Get: it must be a struct pointer or implement datastore.PropertyLoadSaver.
+// This includes []datastore.PropertyList and []*datastore.PropertyList.
 //
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
 func GetMulti(c appengine.Context,
 	keys []*datastore.Key, vals interface{}) error {
+	return defaultClient.GetMulti(c, keys, vals)
+}
+
+// GetMulti works like the package level GetMulti using the Client's Options.
+func (cl *Client) GetMulti(c appengine.Context,
+	keys []*datastore.Key, vals interface{}) error {
 
 	v := reflect.ValueOf(vals)
 	if err := checkMultiArgs(keys, v); err != nil {
@@ -61,14 +83,15 @@ func GetMulti(c appengine.Context,
 		return nil
 	}
 
-	callCount := (len(keys)-1)/getMultiLimit + 1
+	limit := cl.getMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
 	errs := make([]error, callCount)
 
 	wg := sync.WaitGroup{}
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
-		lo := i * getMultiLimit
-		hi := (i + 1) * getMultiLimit
+		lo := i * limit
+		hi := (i + 1) * limit
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -78,11 +101,10 @@ func GetMulti(c appengine.Context,
 		valSlice := v.Slice(lo, hi)
 
 		go func() {
-			if _, ok := transactionContext(c); ok {
-				errs[index] = datastoreGetMulti(c,
-					keySlice, valSlice.Interface())
+			if txc, ok := transactionContext(c); ok {
+				errs[index] = txc.getMulti(keySlice, valSlice)
 			} else {
-				errs[index] = getMulti(c, keySlice, valSlice)
+				errs[index] = cl.getMulti(c, keySlice, valSlice)
 			}
 			wg.Done()
 		}()
@@ -102,8 +124,8 @@ func GetMulti(c appengine.Context,
 
 	groupedErrs := make(appengine.MultiError, len(keys))
 	for i, err := range errs {
-		lo := i * getMultiLimit
-		hi := (i + 1) * getMultiLimit
+		lo := i * limit
+		hi := (i + 1) * limit
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -129,8 +151,14 @@ func GetMulti(c appengine.Context,
 // unexported in the destination struct. ErrFieldMismatch is only returned if
 // val is a struct pointer.
 func Get(c appengine.Context, key *datastore.Key, val interface{}) error {
+	return defaultClient.Get(c, key, val)
+}
+
+// Get works like the package level Get using the Client's Options.
+func (cl *Client) Get(c appengine.Context,
+	key *datastore.Key, val interface{}) error {
 
-	err := GetMulti(c, []*datastore.Key{key}, []interface{}{val})
+	err := cl.GetMulti(c, []*datastore.Key{key}, []interface{}{val})
 	if me, ok := err.(appengine.MultiError); ok {
 		return me[0]
 	}
@@ -147,15 +175,29 @@ const (
 )
 
 type cacheItem struct {
-	key         *datastore.Key
-	memcacheKey string
+	key           *datastore.Key
+	memcacheKey   string
+	localCacheKey string
 
 	val reflect.Value
 	err error
 
-	item *memcache.Item
+	// pl is the loaded entity so that it can be saved to the local cache.
+	pl datastore.PropertyList
+
+	policy Policy
+
+	stats Stats
+
+	item *Item
 
 	state cacheState
+
+	// otherLock is true when the entity is an externalLock because another
+	// request has locked it to cache the entity. Only these entities are
+	// waited for. The locks left on missing entities by Policy.NoCacheMissing
+	// are not as they are never replaced by the entity.
+	otherLock bool
 }
 
 // getMulti attempts to get entities from, memcache, then the datastore.
@@ -164,27 +206,57 @@ type cacheItem struct {
 // function, datastore or server fails at any point. The caching strategy is
 // borrowed from Python ndb with some improvements that eliminate some
 // consistency issues surrounding ndb, including http://goo.gl/3ByVlA.
-func getMulti(c appengine.Context,
+func (cl *Client) getMulti(c appengine.Context,
 	keys []*datastore.Key, vals reflect.Value) error {
 
+	lc, isLocal := localCacheContext(c)
+
 	cacheItems := make([]cacheItem, len(keys))
 	for i, key := range keys {
 		cacheItems[i].key = key
-		cacheItems[i].memcacheKey = createMemcacheKey(key)
 		cacheItems[i].val = vals.Index(i)
-		cacheItems[i].state = miss
+		cacheItems[i].policy = cl.kindPolicy(key.Kind())
+
+		if isLocal {
+			cacheItems[i].localCacheKey = cl.localCacheKey(key)
+		}
+
+		// Entities that shouldn't be cached, or that earlier versions sharing
+		// the cache may change without locking, are read straight from the
+		// datastore.
+		if cacheItems[i].policy.NoCache || legacyCache {
+			cacheItems[i].state = externalLock
+		} else {
+			cacheItems[i].state = miss
+		}
+	}
+
+	// The local cache is checked first as it does not need the generations.
+	var version uint64
+	if isLocal {
+		version = lc.load(cacheItems)
 	}
 
-	loadMemcache(c, cacheItems)
+	cl.createMemcacheKeys(c, cacheItems)
 
-	lockMemcache(c, cacheItems)
+	cl.loadMemcache(c, cacheItems)
 
-	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+	cl.lockMemcache(c, cacheItems)
+
+	cl.waitForLocks(c, cacheItems)
+
+	if err := cl.loadDatastore(c, cacheItems, vals.Type()); err != nil {
 		return err
 	}
 
 	saveMemcache(c, cacheItems)
 
+	if isLocal {
+		lc.save(version, cacheItems)
+	}
+
+	addStats(cacheItems)
+
 	me, errsNil := make(appengine.MultiError, len(cacheItems)), true
 	for i, cacheItem := range cacheItems {
 		if cacheItem.err != nil {
@@ -199,77 +271,156 @@ func getMulti(c appengine.Context,
 	return me
 }
 
-func loadMemcache(c appengine.Context, cacheItems []cacheItem) {
+// createMemcacheKeys sets the memcache keys of the cacheItems that are still
+// misses. Without the generations there are no memcache keys so memcache is
+// not used at all.
+func (cl *Client) createMemcacheKeys(c appengine.Context,
+	cacheItems []cacheItem) {
+
+	keys := make([]*datastore.Key, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			keys = append(keys, cacheItem.key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	gens, err := cl.loadGenerations(c, keys)
+	if err != nil {
+		c.Warningf("nds:createMemcacheKeys loadGenerations %s", err)
+	}
+
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		if err == nil {
+			cacheItems[i].memcacheKey = cl.createMemcacheKey(gens, cacheItem.key)
+		} else {
+			cacheItems[i].state = externalLock
+		}
+	}
+}
+
+func (cl *Client) loadMemcache(c appengine.Context, cacheItems []cacheItem) {
 
-	memcacheKeys := make([]string, len(cacheItems))
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	cacheItemsIndex := make([]int, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
-		memcacheKeys[i] = cacheItem.memcacheKey
+		if cacheItem.state == miss {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+			cacheItemsIndex = append(cacheItemsIndex, i)
+		}
 	}
 
-	items, err := memcacheGetMulti(c, memcacheKeys)
+	items, err := cache.GetMulti(c, memcacheKeys)
 	if err != nil {
-		for i := range cacheItems {
+		for _, i := range cacheItemsIndex {
 			cacheItems[i].state = externalLock
 		}
 		c.Warningf("nds:loadMemcache GetMulti %s", err)
 		return
 	}
 
-	for i, memcacheKey := range memcacheKeys {
+	manifestIndex := []int{}
+	for j, memcacheKey := range memcacheKeys {
+		i := cacheItemsIndex[j]
 		if item, ok := items[memcacheKey]; ok {
 			switch item.Flags {
 			case lockItem:
 				cacheItems[i].state = externalLock
+				cacheItems[i].otherLock = !bytes.Equal(item.Value, missingLock)
 			case noneItem:
 				cacheItems[i].state = done
 				cacheItems[i].err = datastore.ErrNoSuchEntity
-			case entityItem:
-				pl := datastore.PropertyList{}
-				if err := unmarshal(item.Value, &pl); err != nil {
-					c.Warningf("nds:loadMemcache unmarshal %s", err)
-					cacheItems[i].state = externalLock
-					break
-				}
-				if err := setValue(cacheItems[i].val, pl); err == nil {
-					cacheItems[i].state = done
-				} else {
-					c.Warningf("nds:loadMemcache setValue %s", err)
-					cacheItems[i].state = externalLock
-				}
+				cacheItems[i].stats.Hits++
+			case entityItem, compressedEntityItem:
+				cacheItems[i].item = item
+				cl.loadEntityItem(c, &cacheItems[i], item, "nds:loadMemcache")
+			case manifestItem:
+				cacheItems[i].item = item
+				manifestIndex = append(manifestIndex, i)
 			default:
 				c.Warningf("nds:loadMemcache unknown item.Flags %d", item.Flags)
 				cacheItems[i].state = externalLock
 			}
+		} else {
+			cacheItems[i].stats.Misses++
 		}
 	}
+
+	if len(manifestIndex) > 0 {
+		cl.loadChunks(c, cacheItems, manifestIndex)
+	}
+}
+
+// loadEntityItem loads the entity cached in item into cacheItem. prefix is
+// used when logging warnings. If item cannot be decoded, for example because
+// it was cached with another codec version, the cacheItem is left as a miss so
+// that lockMemcache can replace the cached item, which the caller must have
+// stored in cacheItem.item, with a lock and the entity is cached again.
+func (cl *Client) loadEntityItem(c appengine.Context,
+	cacheItem *cacheItem, item *Item, prefix string) {
+
+	pl := datastore.PropertyList{}
+	if err := cl.unmarshalEntity(item, &pl); err != nil {
+		c.Warningf("%s unmarshal %s", prefix, err)
+		cacheItem.state = miss
+		cacheItem.stats.UnmarshalErrors++
+		return
+	}
+	if err := setValue(cacheItem.val, pl); err == nil {
+		cacheItem.state = done
+		cacheItem.pl = pl
+		cacheItem.stats.Hits++
+	} else {
+		c.Warningf("%s setValue %s", prefix, err)
+		cacheItem.state = externalLock
+		cacheItem.stats.SetValueErrors++
+	}
 }
 
-func lockMemcache(c appengine.Context, cacheItems []cacheItem) {
+func (cl *Client) lockMemcache(c appengine.Context, cacheItems []cacheItem) {
 
-	lockItems := make([]*memcache.Item, 0, len(cacheItems))
+	lockItems := make([]*Item, 0, len(cacheItems))
+	casLockItems := []*Item{}
 	lockMemcacheKeys := make([]string, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
 
-			item := &memcache.Item{
+			item := &Item{
 				Key:        cacheItem.memcacheKey,
 				Flags:      lockItem,
 				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+				Expiration: cl.lockTime(),
+			}
+
+			// Manifests with evicted chunks and entities that cannot be
+			// decoded are replaced with the lock only if they haven't
+			// changed since they were got.
+			if cacheItem.item != nil {
+				item.SetCASInfo(cacheItem.item.GetCASInfo())
+				casLockItems = append(casLockItems, item)
+			} else {
+				lockItems = append(lockItems, item)
 			}
 			cacheItems[i].item = item
-			lockItems = append(lockItems, item)
 			lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
 		}
 	}
 
 	// We don't care if there are errors here.
-	if err := memcacheAddMulti(c, lockItems); err != nil {
+	if err := cache.AddMulti(c, lockItems); err != nil {
 		c.Warningf("nds:lockMemcache AddMulti %s", err)
 	}
+	if err := cache.CompareAndSwapMulti(c, casLockItems); err != nil {
+		c.Warningf("nds:lockMemcache CompareAndSwapMulti %s", err)
+	}
 
 	// Get the items again so we can use CAS when updating the cache.
-	items, err := memcacheGetMulti(c, lockMemcacheKeys)
+	items, err := cache.GetMulti(c, lockMemcacheKeys)
 
 	// Cache failed so forget about it and just use the datastore.
 	if err != nil {
@@ -293,23 +444,25 @@ func lockMemcache(c appengine.Context, cacheItems []cacheItem) {
 						cacheItems[i].state = internalLock
 					} else {
 						cacheItems[i].state = externalLock
+						cacheItems[i].otherLock = !bytes.Equal(item.Value,
+							missingLock)
 					}
 				case noneItem:
 					cacheItems[i].state = done
 					cacheItems[i].err = datastore.ErrNoSuchEntity
-				case entityItem:
-					pl := datastore.PropertyList{}
-					if err := unmarshal(item.Value, &pl); err != nil {
-						c.Warningf("nds:lockMemcache unmarshal %s", err)
-						cacheItems[i].state = externalLock
-						break
-					}
-					if err := setValue(cacheItems[i].val, pl); err == nil {
-						cacheItems[i].state = done
-					} else {
-						c.Warningf("nds:lockMemcache setValue %s", err)
+					cacheItems[i].stats.Hits++
+				case entityItem, compressedEntityItem:
+					cl.loadEntityItem(c, &cacheItems[i], item,
+						"nds:lockMemcache")
+					if cacheItems[i].state == miss {
+						// Another request has just cached an entity that
+						// cannot be decoded.
 						cacheItems[i].state = externalLock
 					}
+				case manifestItem:
+					// Another request has just cached a large entity.
+					cacheItems[i].state = externalLock
+					cacheItems[i].otherLock = true
 				default:
 					c.Warningf("nds:lockMemcache unknown item.Flags %d",
 						item.Flags)
@@ -324,7 +477,51 @@ func lockMemcache(c appengine.Context, cacheItems []cacheItem) {
 	}
 }
 
-func loadDatastore(c appengine.Context, cacheItems []cacheItem,
+// waitForLocks polls the cache, backing off exponentially, for entities that
+// other requests have locked until they are cached or the client's LockWait
+// has passed. This stops every request that gets a hot entity while it is
+// being updated from reading it from the datastore. Entities the lock is
+// removed from without being cached are locked by this request instead.
+func (cl *Client) waitForLocks(c appengine.Context, cacheItems []cacheItem) {
+	if cl.opts.LockWait <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(cl.opts.LockWait)
+	delay := lockWaitDelay
+	for {
+		waiting := false
+		for _, cacheItem := range cacheItems {
+			if cacheItem.state == externalLock && cacheItem.otherLock {
+				waiting = true
+				break
+			}
+		}
+		remaining := deadline.Sub(time.Now())
+		if !waiting || remaining <= 0 {
+			return
+		}
+
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		delay *= 2
+
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == externalLock && cacheItem.otherLock {
+				cacheItems[i].state = miss
+				cacheItems[i].otherLock = false
+				cacheItems[i].item = nil
+				cacheItems[i].stats.LockWaits++
+			}
+		}
+		cl.loadMemcache(c, cacheItems)
+		cl.lockMemcache(c, cacheItems)
+	}
+}
+
+func (cl *Client) loadDatastore(c appengine.Context, cacheItems []cacheItem,
 	valsType reflect.Type) error {
 
 	keys := make([]*datastore.Key, 0, len(cacheItems))
@@ -333,11 +530,19 @@ func loadDatastore(c appengine.Context, cacheItems []cacheItem,
 
 	for i, cacheItem := range cacheItems {
 		switch cacheItem.state {
-		case internalLock, externalLock:
-			keys = append(keys, cacheItem.key)
-			vals = append(vals, datastore.PropertyList{})
-			cacheItemsIndex = append(cacheItemsIndex, i)
+		case internalLock:
+			cacheItems[i].stats.InternalLocks++
+		case externalLock:
+			if !cacheItem.policy.NoCache && !legacyCache {
+				cacheItems[i].stats.ExternalLocks++
+			}
+		default:
+			continue
 		}
+		keys = append(keys, cacheItem.key)
+		vals = append(vals, datastore.PropertyList{})
+		cacheItemsIndex = append(cacheItemsIndex, i)
+		cacheItems[i].stats.DatastoreGets++
 	}
 
 	var me appengine.MultiError
@@ -357,11 +562,13 @@ func loadDatastore(c appengine.Context, cacheItems []cacheItem,
 			if err := setValue(val, pl); err != nil {
 				return err
 			}
+			cacheItems[index].pl = pl
 
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
-				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
+				cacheItems[index].item.Expiration =
+					cacheItems[index].policy.Expiration
+				if data, flags, err := cl.marshalEntity(pl); err == nil {
+					cacheItems[index].item.Flags = flags
 					cacheItems[index].item.Value = data
 				} else {
 					cacheItems[index].state = externalLock
@@ -370,9 +577,18 @@ func loadDatastore(c appengine.Context, cacheItems []cacheItem,
 			}
 		case datastore.ErrNoSuchEntity:
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
-				cacheItems[index].item.Value = []byte{}
+				policy := cacheItems[index].policy
+				if policy.NoCacheMissing {
+					// Shorten the lock rather than caching the missing
+					// entity.
+					cacheItems[index].item.Expiration = missingLockTime
+					cacheItems[index].item.Value = missingLock
+				} else {
+					cacheItems[index].item.Flags = noneItem
+					cacheItems[index].item.Expiration =
+						policy.missingExpiration()
+					cacheItems[index].item.Value = []byte{}
+				}
 			}
 			cacheItems[index].err = datastore.ErrNoSuchEntity
 		default:
@@ -385,14 +601,20 @@ func loadDatastore(c appengine.Context, cacheItems []cacheItem,
 
 func saveMemcache(c appengine.Context, cacheItems []cacheItem) {
 
-	saveItems := make([]*memcache.Item, 0, len(cacheItems))
+	saveItems := make([]*Item, 0, len(cacheItems))
+	chunkItems := []*Item{}
 	for _, cacheItem := range cacheItems {
 		if cacheItem.state == internalLock {
+			if len(cacheItem.item.Value) > memcacheMaxItemSize {
+				chunkItems = append(chunkItems, splitItem(cacheItem.item)...)
+			}
 			saveItems = append(saveItems, cacheItem.item)
 		}
 	}
 
-	if err := memcacheCompareAndSwapMulti(c, saveItems); err != nil {
+	saveItems = saveChunks(c, "nds:saveMemcache", saveItems, chunkItems)
+
+	if err := cache.CompareAndSwapMulti(c, saveItems); err != nil {
 		c.Warningf("nds:saveMemcache CompareAndSwapMulti %s", err)
 	}
 }
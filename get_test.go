@@ -4,6 +4,7 @@ import (
 	"io"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/qedus/nds"
 
@@ -245,6 +246,75 @@ func TestGetMultiPropertyLoadSaver(t *testing.T) {
 	}
 }
 
+func TestGetMultiPropertyListPtr(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys := []*datastore.Key{}
+	entities := []*datastore.PropertyList{}
+	for i := 1; i < 3; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", int64(i), nil))
+		entities = append(entities, &datastore.PropertyList{
+			datastore.Property{Name: "IntVal", Value: int64(i)},
+		})
+	}
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	getEntities := func(c appengine.Context) []*datastore.PropertyList {
+		pls := make([]*datastore.PropertyList, len(keys))
+		for i := range pls {
+			pls[i] = &datastore.PropertyList{}
+		}
+		if err := nds.GetMulti(c, keys, pls); err != nil {
+			t.Fatal(err)
+		}
+		return pls
+	}
+
+	// Prime the cache and then use it.
+	for i := 0; i < 2; i++ {
+		for j, pl := range getEntities(c) {
+			if !reflect.DeepEqual(entities[j], pl) {
+				t.Fatal("entities not equal", entities[j], pl)
+			}
+		}
+	}
+
+	if err := nds.RunInTransaction(c, func(tc appengine.Context) error {
+		for j, pl := range getEntities(tc) {
+			if !reflect.DeepEqual(entities[j], pl) {
+				return errors.New("transaction entities not equal")
+			}
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nil elements have nothing to load into or save from.
+	pls := []*datastore.PropertyList{&datastore.PropertyList{}, nil}
+	err = nds.GetMulti(c, keys, pls)
+	if me, ok := err.(appengine.MultiError); !ok || me[0] != nil ||
+		me[1] != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+	_, err = nds.PutMulti(c, keys, pls)
+	if me, ok := err.(appengine.MultiError); !ok || me[0] != nil ||
+		me[1] != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+	if _, err := nds.Put(c, keys[0],
+		(*datastore.PropertyList)(nil)); err != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+}
+
 func TestGetMultiNoKeys(t *testing.T) {
 	c, err := aetest.NewContext(nil)
 	if err != nil {
@@ -466,6 +536,53 @@ func TestGetMultiNonStruct(t *testing.T) {
 	}
 }
 
+func TestGetUndecodableItem(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items cached with an unknown codec version are replaced.
+	memcacheKey := nds.CreateMemcacheKey(c, key)
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.EntityItem,
+		Value: []byte{0, 0xff},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity to be cached", item.Flags)
+	}
+	pl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(item.Value, &pl); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetMultiLockReturnEntitySetValueFail(t *testing.T) {
 	c, err := aetest.NewContext(nil)
 	if err != nil {
@@ -490,7 +607,9 @@ func TestGetMultiLockReturnEntitySetValueFail(t *testing.T) {
 
 	// Fail to unmarshal test.
 	memcacheGetChan := make(chan func(c appengine.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
+		map[string]*memcache.Item, error), 3)
+	// Load the generations and then the items.
+	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- func(c appengine.Context,
 		keys []string) (map[string]*memcache.Item, error) {
@@ -553,7 +672,9 @@ func TestGetMultiLockReturnEntity(t *testing.T) {
 	}
 
 	memcacheGetChan := make(chan func(c appengine.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
+		map[string]*memcache.Item, error), 3)
+	// Load the generations and then the items.
+	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- func(c appengine.Context,
 		keys []string) (map[string]*memcache.Item, error) {
@@ -616,7 +737,9 @@ func TestGetMultiLockReturnUnknown(t *testing.T) {
 	}
 
 	memcacheGetChan := make(chan func(c appengine.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
+		map[string]*memcache.Item, error), 3)
+	// Load the generations and then the items.
+	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- func(c appengine.Context,
 		keys []string) (map[string]*memcache.Item, error) {
@@ -672,7 +795,9 @@ func TestGetMultiLockReturnMiss(t *testing.T) {
 	}
 
 	memcacheGetChan := make(chan func(c appengine.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
+		map[string]*memcache.Item, error), 3)
+	// Load the generations and then the items.
+	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- nds.ZeroMemcacheGetMulti
 	memcacheGetChan <- func(c appengine.Context,
 		keys []string) (map[string]*memcache.Item, error) {
@@ -777,7 +902,8 @@ func TestGetMultiPaths(t *testing.T) {
 		// Number of times GetMulti is called.
 		callCount int
 
-		// There are 2 memcacheGetMulti calls for every GetMulti call.
+		// There are 3 memcacheGetMulti calls for every GetMulti call. The
+		// first loads the generations.
 		memcacheGetMultis           []memcacheGetMultiFunc
 		memcacheAddMulti            memcacheAddMultiFunc
 		memcacheCompareAndSwapMulti memcacheCompareAndSwapMultiFunc
@@ -797,6 +923,7 @@ func TestGetMultiPaths(t *testing.T) {
 			[]memcacheGetMultiFunc{
 				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
+				nds.ZeroMemcacheGetMulti,
 			},
 			nds.ZeroMemcacheAddMulti,
 			nds.ZeroMemcacheCompareAndSwapMulti,
@@ -815,6 +942,7 @@ func TestGetMultiPaths(t *testing.T) {
 			[]memcacheGetMultiFunc{
 				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
+				nds.ZeroMemcacheGetMulti,
 			},
 			nds.ZeroMemcacheAddMulti,
 			nds.ZeroMemcacheCompareAndSwapMulti,
@@ -833,6 +961,7 @@ func TestGetMultiPaths(t *testing.T) {
 			[]memcacheGetMultiFunc{
 				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
+				nds.ZeroMemcacheGetMulti,
 			},
 			nds.ZeroMemcacheAddMulti,
 			nds.ZeroMemcacheCompareAndSwapMulti,
@@ -861,6 +990,7 @@ func TestGetMultiPaths(t *testing.T) {
 			[]memcacheGetMultiFunc{
 				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
+				nds.ZeroMemcacheGetMulti,
 			},
 			nds.ZeroMemcacheAddMulti,
 			nds.ZeroMemcacheCompareAndSwapMulti,
@@ -879,6 +1009,7 @@ func TestGetMultiPaths(t *testing.T) {
 			[]memcacheGetMultiFunc{
 				memcacheGetMultiFail,
 				memcacheGetMultiFail,
+				memcacheGetMultiFail,
 			},
 			memcacheAddMultiFail,
 			memcacheCompareAndSwapMultiFail,
@@ -895,6 +1026,7 @@ func TestGetMultiPaths(t *testing.T) {
 			20,
 			1,
 			[]memcacheGetMultiFunc{
+				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
 				memcacheGetMultiFail,
 			},
@@ -916,7 +1048,9 @@ func TestGetMultiPaths(t *testing.T) {
 				// Charge memcache.
 				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
+				nds.ZeroMemcacheGetMulti,
 				// Corrupt memcache.
+				nds.ZeroMemcacheGetMulti,
 				func(c appengine.Context, keys []string) (
 					map[string]*memcache.Item, error) {
 					items, err := memcache.GetMulti(c, keys)
@@ -948,7 +1082,9 @@ func TestGetMultiPaths(t *testing.T) {
 				// Charge memcache.
 				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
+				nds.ZeroMemcacheGetMulti,
 				// Corrupt memcache flags.
+				nds.ZeroMemcacheGetMulti,
 				func(c appengine.Context, keys []string) (
 					map[string]*memcache.Item, error) {
 					items, err := memcache.GetMulti(c, keys)
@@ -977,6 +1113,7 @@ func TestGetMultiPaths(t *testing.T) {
 			20,
 			1,
 			[]memcacheGetMultiFunc{
+				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
 				func(c appengine.Context, keys []string) (
 					map[string]*memcache.Item, error) {
@@ -1003,6 +1140,7 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			1,
 			[]memcacheGetMultiFunc{
+				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
 				func(c appengine.Context, keys []string) (
 					map[string]*memcache.Item, error) {
@@ -1034,6 +1172,7 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			1,
 			[]memcacheGetMultiFunc{
+				nds.ZeroMemcacheGetMulti,
 				nds.ZeroMemcacheGetMulti,
 				func(c appengine.Context, keys []string) (
 					map[string]*memcache.Item, error) {
@@ -1159,3 +1298,192 @@ func TestGetMultiPaths(t *testing.T) {
 		t.Log("End", test.description)
 	}
 }
+
+func TestGetMultiLockWait(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.ResetStats()
+	defer nds.ResetStats()
+
+	cl, err := nds.NewClient(nds.Options{LockWait: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.NewKey(c, "LockWaitEntity", "", 1, nil)
+	if _, err := datastore.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock the entity as if another request were refreshing it.
+	memcacheKey := cl.CreateMemcacheKey(c, key)
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: []byte("lock"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other request caches the entity while the get is waiting.
+	done := make(chan error)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := memcache.Delete(c, memcacheKey); err != nil {
+			done <- err
+			return
+		}
+		done <- nds.Get(c, key, &testEntity{})
+	}()
+
+	te := &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity to be cached", item.Flags)
+	}
+	if stats := nds.ReadStats()["LockWaitEntity"]; stats.LockWaits == 0 {
+		t.Fatal("expected lock waits")
+	}
+}
+
+func TestSetLockWait(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.ResetStats()
+	defer nds.ResetStats()
+
+	nds.SetLockWait(time.Second)
+	defer nds.SetLockWait(0)
+
+	key := datastore.NewKey(c, "SetLockWaitEntity", "", 1, nil)
+	if _, err := datastore.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(c, key)
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: []byte("lock"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		memcache.Delete(c, memcacheKey)
+	}()
+
+	// The package level Get waits for the lock to be removed.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+	if stats := nds.ReadStats()["SetLockWaitEntity"]; stats.LockWaits == 0 {
+		t.Fatal("expected lock waits")
+	}
+
+	// Clients that leave LockWait as zero do not wait.
+	cl, err := nds.NewClient(nds.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: []byte("lock"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	nds.ResetStats()
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := nds.ReadStats()["SetLockWaitEntity"]; stats.LockWaits != 0 {
+		t.Fatal("expected no lock waits", stats.LockWaits)
+	}
+}
+
+func TestGetMultiLockWaitTimeout(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cl, err := nds.NewClient(nds.Options{LockWait: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := datastore.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := cl.CreateMemcacheKey(c, key)
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: []byte("lock"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entity is read from the datastore once the wait is over.
+	start := time.Now()
+	te := &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("expected get to wait for the lock")
+	}
+
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected the lock to remain", item.Flags)
+	}
+}
@@ -0,0 +1,105 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestInvalidate(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.NewContext(c)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entity and then change it behind nds' back.
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 1 {
+		t.Fatal("expected stale entity", te.IntVal)
+	}
+
+	if err := nds.Invalidate(lc, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+
+	te = &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 2 {
+		t.Fatal("expected new entity", te.IntVal)
+	}
+
+	// Invalidating keys that are not cached is not an error.
+	uncachedKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	if err := nds.Invalidate(lc,
+		[]*datastore.Key{key, uncachedKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	incompleteKey := datastore.NewIncompleteKey(c, "Entity", nil)
+	if err := nds.Invalidate(c,
+		[]*datastore.Key{incompleteKey}); err != datastore.ErrInvalidKey {
+		t.Fatal("expected invalid key error", err)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := datastore.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Warm(nds.NewContext(c), keys); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedFlags := []uint32{nds.EntityItem, nds.NoneItem}
+	for i, key := range keys {
+		item, err := memcache.Get(c, nds.CreateMemcacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Flags != expectedFlags[i] {
+			t.Fatal("expected flags", expectedFlags[i], "got", item.Flags)
+		}
+	}
+}
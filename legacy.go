@@ -0,0 +1,62 @@
+package nds
+
+import (
+	"appengine/datastore"
+)
+
+// legacyPrefix is the cache key prefix of the versions of nds that cached
+// entities without generations.
+const legacyPrefix = "NDS1:"
+
+// legacyCache is true while app versions that use legacyPrefix may share the
+// cache.
+var legacyCache = false
+
+// SetLegacyCache makes nds safe to use while app versions with a version of nds
+// that caches entities under "NDS1:" keys share the same cache. While it is
+// enabled, puts, deletes, transactions and Invalidate also lock and remove the
+// "NDS1:" keys those versions read, so they never serve an entity changed by
+// this version. Those versions do not lock the keys this version caches under,
+// so gets read from the datastore instead of the cache and puts do not cache
+// entities. Enable it before deploying this version next to an earlier one
+// and disable it once the earlier version has stopped serving requests. It is
+// disabled by default.
+//
+// It is not safe to call SetLegacyCache concurrently with other nds functions
+// so it should be called once during app initialisation.
+func SetLegacyCache(enabled bool) {
+	legacyCache = enabled
+}
+
+// legacyLockItems returns locks for the "NDS1:" cache keys of keys when
+// SetLegacyCache is enabled and nil otherwise.
+func (cl *Client) legacyLockItems(keys []*datastore.Key) []*Item {
+	if !legacyCache {
+		return nil
+	}
+
+	items := make([]*Item, len(keys))
+	for i, key := range keys {
+		items[i] = &Item{
+			Key:        legacyPrefix + key.Encode(),
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: cl.lockTime(),
+		}
+	}
+	return items
+}
+
+// legacyMemcacheKeys returns the "NDS1:" cache keys of keys when
+// SetLegacyCache is enabled and nil otherwise.
+func legacyMemcacheKeys(keys []*datastore.Key) []string {
+	if !legacyCache {
+		return nil
+	}
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = legacyPrefix + key.Encode()
+	}
+	return memcacheKeys
+}
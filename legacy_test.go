@@ -0,0 +1,147 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestSetLegacyCacheWrites(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetLegacyCache(true)
+	defer nds.SetLegacyCache(false)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	legacyKey := "NDS1:" + key.Encode()
+
+	// cacheLegacy caches the entity as an earlier version of nds would.
+	cacheLegacy := func() {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:   legacyKey,
+			Flags: nds.EntityItem,
+			Value: []byte("entity"),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRemoved := func(description string) {
+		if _, err := memcache.Get(c, legacyKey); err != memcache.ErrCacheMiss {
+			t.Fatal("expected legacy item to be removed by", description,
+				err)
+		}
+	}
+
+	legacyLocks := 0
+	nds.SetMemcacheSetMulti(func(c appengine.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Key == legacyKey && item.Flags == nds.LockItem {
+				legacyLocks++
+			}
+		}
+		return nds.ZeroMemcacheSetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(nds.ZeroMemcacheSetMulti)
+
+	cacheLegacy()
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	checkRemoved("put")
+	if legacyLocks != 1 {
+		t.Fatal("expected put to lock legacy item", legacyLocks)
+	}
+
+	cacheLegacy()
+	if err := nds.RunInTransaction(c, func(tc appengine.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{2})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRemoved("transaction")
+	if legacyLocks != 2 {
+		t.Fatal("expected transaction to lock legacy item", legacyLocks)
+	}
+
+	cacheLegacy()
+	if err := nds.Invalidate(c, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	checkRemoved("invalidate")
+
+	// Deletes leave their locks to expire.
+	cacheLegacy()
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := memcache.Get(c, legacyKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected delete to lock legacy item", item.Flags)
+	}
+}
+
+func TestSetLegacyCacheGet(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetLegacyCache(true)
+	defer nds.SetLegacyCache(false)
+	nds.SetWriteThrough(true)
+	defer nds.SetWriteThrough(false)
+
+	// An earlier version changes the entity without locking the cache.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 2 {
+		t.Fatal("expected entity from the datastore", te.IntVal)
+	}
+
+	// Entities are neither cached by puts nor by gets.
+	if _, err := nds.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(c, key)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected entity not to be cached", err)
+	}
+}
@@ -0,0 +1,170 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strconv"
+
+	"appengine"
+)
+
+// memcacheMaxItemSize is the maximum size in bytes of a value that can be
+// stored in a single memcache item. Larger entities are split across several
+// chunk items that are described by a manifest item. The manifest item takes
+// the place of the entity item so it carries the usual lock and CAS semantics.
+const memcacheMaxItemSize = 1000000
+
+// manifestSize is the size in bytes of an encoded manifest.
+const manifestSize = 16
+
+// manifest describes the chunk items an entity was split into.
+type manifest struct {
+	// id makes the chunk keys unique to this manifest so that chunks from
+	// different versions of an entity are never mixed.
+	id uint64
+
+	// flags are the item flags of the assembled chunks.
+	flags uint32
+
+	chunkCount uint32
+}
+
+func (m manifest) chunkKey(memcacheKey string, i int) string {
+	return memcacheKey + ":" + strconv.FormatUint(m.id, 16) + ":" +
+		strconv.Itoa(i)
+}
+
+func encodeManifest(m manifest) []byte {
+	b := make([]byte, manifestSize)
+	binary.LittleEndian.PutUint64(b[0:8], m.id)
+	binary.LittleEndian.PutUint32(b[8:12], m.flags)
+	binary.LittleEndian.PutUint32(b[12:16], m.chunkCount)
+	return b
+}
+
+func decodeManifest(b []byte) (manifest, error) {
+	if len(b) != manifestSize {
+		return manifest{}, errors.New("nds: invalid manifest length")
+	}
+	return manifest{
+		id:         binary.LittleEndian.Uint64(b[0:8]),
+		flags:      binary.LittleEndian.Uint32(b[8:12]),
+		chunkCount: binary.LittleEndian.Uint32(b[12:16]),
+	}, nil
+}
+
+// splitItem turns item into a manifest item and returns the chunk items that
+// hold its original value. The chunks must be stored before the manifest.
+func splitItem(item *Item) []*Item {
+	m := manifest{
+		id:         uint64(rand.Int63()),
+		flags:      item.Flags,
+		chunkCount: uint32((len(item.Value)-1)/memcacheMaxItemSize + 1),
+	}
+
+	chunkItems := make([]*Item, m.chunkCount)
+	for i := range chunkItems {
+		lo := i * memcacheMaxItemSize
+		hi := (i + 1) * memcacheMaxItemSize
+		if hi > len(item.Value) {
+			hi = len(item.Value)
+		}
+		chunkItems[i] = &Item{
+			Key:        m.chunkKey(item.Key, i),
+			Flags:      chunkItem,
+			Value:      item.Value[lo:hi],
+			Expiration: item.Expiration,
+		}
+	}
+
+	item.Flags = manifestItem
+	item.Value = encodeManifest(m)
+	return chunkItems
+}
+
+// saveChunks saves chunkItems, the chunks split from the manifest items in
+// items. Chunks must be saved before the manifests that describe them so if
+// they cannot be saved, items is returned without its manifest items. name
+// identifies the caller in warnings.
+func saveChunks(c appengine.Context, name string,
+	items, chunkItems []*Item) []*Item {
+
+	if err := cache.SetMulti(c, chunkItems); err != nil {
+		c.Warningf("%s SetMulti %s", name, err)
+
+		saveItems := make([]*Item, 0, len(items))
+		for _, item := range items {
+			if item.Flags != manifestItem {
+				saveItems = append(saveItems, item)
+			}
+		}
+		return saveItems
+	}
+	return items
+}
+
+// loadChunks loads the entities described by the manifest items of the
+// cacheItems at cacheItemsIndex. If any of the chunks have been evicted the
+// cacheItem is left as a miss so that lockMemcache can replace the manifest
+// with a lock.
+func (cl *Client) loadChunks(c appengine.Context,
+	cacheItems []cacheItem, cacheItemsIndex []int) {
+
+	manifests := make([]manifest, len(cacheItemsIndex))
+	chunkKeys := []string{}
+	for j, i := range cacheItemsIndex {
+		m, err := decodeManifest(cacheItems[i].item.Value)
+		if err != nil {
+			c.Warningf("nds:loadChunks decodeManifest %s", err)
+			cacheItems[i].state = externalLock
+			cacheItems[i].stats.UnmarshalErrors++
+			continue
+		}
+		manifests[j] = m
+
+		for k := 0; k < int(m.chunkCount); k++ {
+			chunkKeys = append(chunkKeys,
+				m.chunkKey(cacheItems[i].memcacheKey, k))
+		}
+	}
+
+	items, err := cache.GetMulti(c, chunkKeys)
+	if err != nil {
+		for _, i := range cacheItemsIndex {
+			if cacheItems[i].state == miss {
+				cacheItems[i].state = externalLock
+			}
+		}
+		c.Warningf("nds:loadChunks GetMulti %s", err)
+		return
+	}
+
+	for j, i := range cacheItemsIndex {
+		if cacheItems[i].state != miss {
+			continue
+		}
+
+		m := manifests[j]
+		value, complete := []byte{}, true
+		for k := 0; k < int(m.chunkCount); k++ {
+			item, ok := items[m.chunkKey(cacheItems[i].memcacheKey, k)]
+			if !ok || item.Flags != chunkItem {
+				complete = false
+				break
+			}
+			value = append(value, item.Value...)
+		}
+
+		if !complete {
+			cacheItems[i].stats.Misses++
+			continue
+		}
+
+		cl.loadEntityItem(c, &cacheItems[i], &Item{
+			Key:   cacheItems[i].memcacheKey,
+			Value: value,
+			Flags: m.flags,
+		}, "nds:loadChunks")
+	}
+}
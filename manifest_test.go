@@ -0,0 +1,206 @@
+package nds_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func newLargeTestEntityValue() []byte {
+	b := make([]byte, 2500000)
+	for i := range b {
+		b[i] = byte(rand.Intn(256))
+	}
+	return b
+}
+
+func TestGetLargeEntity(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		Data []byte `datastore:",noindex"`
+	}
+
+	data := newLargeTestEntityValue()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{data}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(te.Data, data) {
+		t.Fatal("incorrect data")
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(c, key)
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.ManifestItem {
+		t.Fatal("expected manifest item", item.Flags)
+	}
+	chunkKeys, err := nds.ChunkKeys(memcacheKey, item.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunkKeys) != 3 {
+		t.Fatal("expected 3 chunks", len(chunkKeys))
+	}
+
+	// Get from cache.
+	nds.SetDatastoreGetMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		return errors.New("expected entity from cache")
+	})
+	te = &testEntity{}
+	err = nds.Get(c, key, te)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(te.Data, data) {
+		t.Fatal("incorrect data")
+	}
+
+	// Updating the entity replaces the manifest with a lock.
+	data = newLargeTestEntityValue()
+	if _, err := nds.Put(c, key, &testEntity{data}); err != nil {
+		t.Fatal(err)
+	}
+	te = &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(te.Data, data) {
+		t.Fatal("incorrect data after put")
+	}
+}
+
+func TestGetLargeEntityEvictedChunk(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		Data []byte `datastore:",noindex"`
+	}
+
+	data := newLargeTestEntityValue()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{data}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(c, key)
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkKeys, err := nds.ChunkKeys(memcacheKey, item.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Delete(c, chunkKeys[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore and repair the cache.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(te.Data, data) {
+		t.Fatal("incorrect data")
+	}
+
+	newItem, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newItem.Flags != nds.ManifestItem {
+		t.Fatal("expected manifest item", newItem.Flags)
+	}
+	if bytes.Equal(newItem.Value, item.Value) {
+		t.Fatal("expected a new manifest")
+	}
+
+	// Get from cache.
+	te = &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(te.Data, data) {
+		t.Fatal("incorrect data")
+	}
+}
+
+func TestGetLargeEntityChunkSaveFailure(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		Data []byte `datastore:",noindex"`
+	}
+
+	data := newLargeTestEntityValue()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{data}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheSetMulti(func(c appengine.Context,
+		items []*memcache.Item) error {
+		if len(items) == 0 {
+			return nil
+		}
+		return errors.New("expected error")
+	})
+	defer nds.SetMemcacheSetMulti(nds.ZeroMemcacheSetMulti)
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(te.Data, data) {
+		t.Fatal("incorrect data")
+	}
+
+	// The manifest must not be saved without its chunks.
+	item, err := memcache.Get(c, nds.CreateMemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected lock item", item.Flags)
+	}
+}
@@ -1,9 +1,7 @@
 package nds
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"errors"
 	"math/rand"
 	"reflect"
@@ -17,7 +15,7 @@ import (
 
 const (
 	// memcachePrefix is the namespace memcache uses to store entities.
-	memcachePrefix = "NDS1:"
+	memcachePrefix = "NDS2:"
 
 	// memcacheLockTime is the maximum length of time a memcache lock will be
 	// held for. 32 seconds is choosen as 30 seconds is the maximum amount of
@@ -97,16 +95,12 @@ const (
 	noneItem uint32 = iota
 	entityItem
 	lockItem
+	compressedEntityItem
+	manifestItem
+	chunkItem
+	generationItem
 )
 
-func init() {
-	gob.Register(time.Time{})
-	gob.Register(datastore.ByteString{})
-	gob.Register(&datastore.Key{})
-	gob.Register(appengine.BlobKey(""))
-	gob.Register(appengine.GeoPoint{})
-}
-
 func itemLock() []byte {
 	b := make([]byte, 4)
 	binary.LittleEndian.PutUint32(b, rand.Uint32())
@@ -143,19 +137,53 @@ func checkMultiArgs(keys []*datastore.Key, v reflect.Value) error {
 	}
 
 	switch elemType.Kind() {
-	case reflect.Struct, reflect.Interface:
+	case reflect.Struct:
 		return nil
+	case reflect.Interface:
+		return checkNilPropertyLists(v)
 	case reflect.Ptr:
 		elemType = elemType.Elem()
 		if elemType.Kind() == reflect.Struct {
 			return nil
 		}
+		if elemType == typeOfPropertyList {
+			return checkNilPropertyLists(v)
+		}
 	}
 	return errors.New("nds: unsupported vals type")
 }
 
-func createMemcacheKey(key *datastore.Key) string {
-	return memcachePrefix + key.Encode()
+// checkNilPropertyLists returns datastore.ErrInvalidEntityType for each
+// element of v that is a nil *datastore.PropertyList, as there is nothing to
+// load into or save from them.
+func checkNilPropertyLists(v reflect.Value) error {
+	isNilErr, nilErr := false, make(appengine.MultiError, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		pl, ok := v.Index(i).Interface().(*datastore.PropertyList)
+		if ok && pl == nil {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidEntityType
+		}
+	}
+	if isNilErr {
+		return nilErr
+	}
+	return nil
+}
+
+// datastoreVals returns the vals slice v in a form accepted by the datastore
+// package. The datastore package does not support []*datastore.PropertyList
+// so it is converted to an []interface{} of the same PropertyList pointers.
+func datastoreVals(v reflect.Value) interface{} {
+	if v.Type().Elem() != reflect.PtrTo(typeOfPropertyList) {
+		return v.Interface()
+	}
+
+	vals := make([]interface{}, v.Len())
+	for i := range vals {
+		vals[i] = v.Index(i).Interface()
+	}
+	return vals
 }
 
 // SaveStruct saves src to a datastore.PropertyList. src must be a struct
@@ -211,15 +239,50 @@ func propertyListToPropertyLoadSaver(
 }
 
 func marshalPropertyList(pl datastore.PropertyList) ([]byte, error) {
-	buf := bytes.Buffer{}
-	if err := gob.NewEncoder(&buf).Encode(&pl); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return encodePropertyList(pl)
 }
 
+// unmarshalPropertyList decodes data written by marshalPropertyList.
 func unmarshalPropertyList(data []byte, pl *datastore.PropertyList) error {
-	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(pl)
+	return decodePropertyList(data, pl)
+}
+
+// saveValue saves val, a valid element of a PutMulti vals slice, to pl. The
+// values in pl are normalised so that pl matches the entity a get from the
+// datastore would return.
+func saveValue(val reflect.Value, pl *datastore.PropertyList) error {
+
+	if reflect.PtrTo(val.Type()).Implements(typeOfPropertyLoadSaver) {
+		val = val.Addr()
+	}
+
+	var err error
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		err = propertyLoadSaverToPropertyList(pls, pl)
+	} else {
+		if val.Kind() == reflect.Struct {
+			val = val.Addr()
+		}
+		err = SaveStruct(val.Interface(), pl)
+	}
+	if err != nil {
+		return err
+	}
+
+	normalizeProperties(*pl)
+	return nil
+}
+
+// normalizeProperties converts the values in pl to the form the datastore
+// stores them in. Times are stored with microsecond precision and are loaded
+// in UTC.
+func normalizeProperties(pl datastore.PropertyList) {
+	for i, p := range pl {
+		if t, ok := p.Value.(time.Time); ok {
+			pl[i].Value = time.Unix(t.Unix(),
+				int64(t.Nanosecond()/1e3*1e3)).UTC()
+		}
+	}
 }
 
 func setValue(val reflect.Value, pl datastore.PropertyList) error {
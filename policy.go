@@ -0,0 +1,67 @@
+package nds
+
+import (
+	"time"
+)
+
+// Policy controls how entities of a kind are cached.
+type Policy struct {
+	// NoCache stops entities of the kind from being cached. Gets always read
+	// from the datastore. Puts and deletes still lock the cache so that
+	// changing a kind's policy never exposes stale entities.
+	NoCache bool
+
+	// Expiration is the maximum duration that an entity of the kind will stay
+	// in the cache. The zero value means entities have no expiration time.
+	Expiration time.Duration
+
+	// NoCacheMissing stops gets from caching that entities of the kind do not
+	// exist, so every get for a missing entity reads the datastore. This
+	// stops probes for keys that are unlikely to exist, such as username
+	// availability checks, from filling the cache.
+	NoCacheMissing bool
+
+	// MissingExpiration is the maximum duration that a missing entity of the
+	// kind will stay in the cache. The zero value means Expiration is used.
+	MissingExpiration time.Duration
+}
+
+// missingLockTime is how long a get keeps its lock on a missing entity that
+// is not cached because of Policy.NoCacheMissing. The lock cannot be removed
+// outright as a put or delete may have replaced it.
+const missingLockTime = time.Second
+
+// missingLock is the value of the lock a get leaves on a missing entity that
+// is not cached because of Policy.NoCacheMissing. It is longer than the values
+// returned by itemLock so that other gets never mistake it for the lock of a
+// request that is about to cache the entity and wait for it.
+var missingLock = []byte("missing")
+
+func (p Policy) missingExpiration() time.Duration {
+	if p.MissingExpiration == 0 {
+		return p.Expiration
+	}
+	return p.MissingExpiration
+}
+
+// SetKindPolicy sets the caching policy the package level functions use for
+// entities of kind. Kinds without a policy use the zero value Policy, which
+// caches entities with no expiration time. Clients use the KindPolicies of
+// their Options instead. Policies should be set during app initialisation so
+// that all instances use the same policy.
+func SetKindPolicy(kind string, p Policy) {
+	defaultClient.policiesMutex.Lock()
+	defer defaultClient.policiesMutex.Unlock()
+
+	if defaultClient.opts.KindPolicies == nil {
+		defaultClient.opts.KindPolicies = map[string]Policy{}
+	}
+	defaultClient.opts.KindPolicies[kind] = p
+}
+
+func (cl *Client) kindPolicy(kind string) Policy {
+	cl.policiesMutex.RLock()
+	defer cl.policiesMutex.RUnlock()
+
+	return cl.opts.KindPolicies[kind]
+}
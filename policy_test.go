@@ -0,0 +1,291 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestKindPolicyNoCache(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetKindPolicy("NoCacheEntity", nds.Policy{NoCache: true})
+	defer nds.SetKindPolicy("NoCacheEntity", nds.Policy{})
+
+	key := datastore.NewKey(c, "NoCacheEntity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(c, key, te); err != nil {
+			t.Fatal(err)
+		}
+		if te.IntVal != 43 {
+			t.Fatal("te.IntVal != 43", te.IntVal)
+		}
+	}
+
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(c, key)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected entity not to be cached", err)
+	}
+
+	// Missing entities are not cached either.
+	missingKey := datastore.NewKey(c, "NoCacheEntity", "", 2, nil)
+	if err := nds.Get(c,
+		missingKey, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(c, missingKey)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected missing entity not to be cached", err)
+	}
+
+	// The context cache is not used either.
+	lc := nds.NewContext(c)
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, key, &testEntity{64}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 64 {
+		t.Fatal("te.IntVal != 64", te.IntVal)
+	}
+}
+
+func TestKindPolicyExpiration(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	expiration := 10 * time.Minute
+	nds.SetKindPolicy("ExpiringEntity", nds.Policy{Expiration: expiration})
+	defer nds.SetKindPolicy("ExpiringEntity", nds.Policy{})
+
+	expirations := map[string]time.Duration{}
+	nds.SetMemcacheCompareAndSwapMulti(func(c appengine.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expirations[item.Key] = item.Expiration
+		}
+		return nds.ZeroMemcacheCompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(
+		nds.ZeroMemcacheCompareAndSwapMulti)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "ExpiringEntity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+	entities := []testEntity{testEntity{1}, testEntity{2}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, ok := expirations[nds.CreateMemcacheKey(c, keys[0])]; !ok {
+		t.Fatal("expected entity to be cached")
+	} else if exp != expiration {
+		t.Fatal("incorrect expiration", exp)
+	}
+
+	if exp, ok := expirations[nds.CreateMemcacheKey(c, keys[1])]; !ok {
+		t.Fatal("expected entity to be cached")
+	} else if exp != 0 {
+		t.Fatal("expected no expiration", exp)
+	}
+}
+
+func TestKindPolicyMissingExpiration(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	expiration, missingExpiration := 10*time.Minute, time.Minute
+	nds.SetKindPolicy("MissingEntity", nds.Policy{
+		Expiration:        expiration,
+		MissingExpiration: missingExpiration,
+	})
+	defer nds.SetKindPolicy("MissingEntity", nds.Policy{})
+
+	expirations := map[string]time.Duration{}
+	nds.SetMemcacheCompareAndSwapMulti(func(c appengine.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expirations[item.Key] = item.Expiration
+		}
+		return nds.ZeroMemcacheCompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(
+		nds.ZeroMemcacheCompareAndSwapMulti)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "MissingEntity", "", 1, nil),
+		datastore.NewKey(c, "MissingEntity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = nds.GetMulti(c, keys, make([]testEntity, 2))
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected second entity to be missing", err)
+	}
+
+	if exp := expirations[nds.CreateMemcacheKey(c, keys[0])]; exp !=
+		expiration {
+		t.Fatal("incorrect entity expiration", exp)
+	}
+	if exp := expirations[nds.CreateMemcacheKey(c, keys[1])]; exp !=
+		missingExpiration {
+		t.Fatal("incorrect missing entity expiration", exp)
+	}
+}
+
+func TestKindPolicyNoCacheMissing(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetKindPolicy("NoCacheMissingEntity",
+		nds.Policy{NoCacheMissing: true})
+	defer nds.SetKindPolicy("NoCacheMissingEntity", nds.Policy{})
+
+	key := datastore.NewKey(c, "NoCacheMissingEntity", "", 1, nil)
+	missingKey := datastore.NewKey(c, "NoCacheMissingEntity", "", 2, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(c, missingKey,
+			&testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", err)
+		}
+	}
+
+	item, err := memcache.Get(c, nds.CreateMemcacheKey(c, missingKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected missing entity not to be cached", item.Flags)
+	}
+
+	// Entities that exist are still cached.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	item, err = memcache.Get(c, nds.CreateMemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity to be cached", item.Flags)
+	}
+
+	// The entity is got once it has been put.
+	if _, err := nds.Put(c, missingKey, &testEntity{64}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(c, missingKey, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 64 {
+		t.Fatal("te.IntVal != 64", te.IntVal)
+	}
+}
+
+func TestKindPolicyNoCacheMissingLockWait(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.ResetStats()
+	defer nds.ResetStats()
+
+	cl, err := nds.NewClient(nds.Options{
+		LockWait: time.Second,
+		KindPolicies: map[string]nds.Policy{
+			"NoCacheMissingEntity": {NoCacheMissing: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get leaves a lock on the missing entity that later gets must
+	// not wait for.
+	missingKey := datastore.NewKey(c, "NoCacheMissingEntity", "", 1, nil)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := cl.Get(c, missingKey,
+			&testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", err)
+		}
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("expected get not to wait for the lock")
+	}
+	if stats := nds.ReadStats()["NoCacheMissingEntity"]; stats.LockWaits != 0 {
+		t.Fatal("expected no lock waits", stats.LockWaits)
+	}
+
+	item, err := memcache.Get(c, cl.CreateMemcacheKey(c, missingKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected missing entity not to be cached", item.Flags)
+	}
+}
@@ -66,6 +66,48 @@ func TestPutPropertyLoadSaver(t *testing.T) {
 	}
 }
 
+func TestPutMultiPropertyList(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Test", "", 1, nil),
+		datastore.NewKey(c, "Test", "", 2, nil),
+	}
+
+	pls := []datastore.PropertyList{
+		{datastore.Property{Name: "IntVal", Value: int64(1)}},
+		{datastore.Property{Name: "IntVal", Value: int64(2)}},
+	}
+	if _, err := nds.PutMulti(c, keys, pls); err != nil {
+		t.Fatal(err)
+	}
+
+	plPtrs := []*datastore.PropertyList{
+		{datastore.Property{Name: "IntVal", Value: int64(3)}},
+		{datastore.Property{Name: "IntVal", Value: int64(4)}},
+	}
+	if err := nds.RunInTransaction(c, func(tc appengine.Context) error {
+		_, err := nds.PutMulti(tc, keys, plPtrs)
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	getPls := make([]datastore.PropertyList, len(keys))
+	if err := datastore.GetMulti(c, keys, getPls); err != nil {
+		t.Fatal(err)
+	}
+	for i, pl := range getPls {
+		if len(pl) != 1 || pl[0].Value != int64(i+3) {
+			t.Fatal("incorrect entity", pl)
+		}
+	}
+}
+
 func TestPutNilArgs(t *testing.T) {
 	c, err := aetest.NewContext(nil)
 	if err != nil {
@@ -178,3 +220,111 @@ func TestPutMultiZeroKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPutMultiLimit(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	for _, count := range []int{499, 500, 501, 1200} {
+
+		keys := []*datastore.Key{}
+		entities := []testEntity{}
+		for i := 0; i < count; i++ {
+			keys = append(keys, datastore.NewIncompleteKey(c, "Test", nil))
+			entities = append(entities, testEntity{i})
+		}
+
+		putKeys, err := nds.PutMulti(c, keys, entities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(putKeys) != count {
+			t.Fatal("incorrect number of keys", len(putKeys))
+		}
+
+		respEntities := make([]testEntity, count)
+		if err := nds.GetMulti(c, putKeys, respEntities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Check keys are in order.
+		for i, re := range respEntities {
+			if re.IntVal != entities[i].IntVal {
+				t.Fatalf("putKeys in wrong order, %d vs %d", re.IntVal,
+					entities[i].IntVal)
+			}
+		}
+	}
+}
+
+func TestPutMultiLimitMultiError(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	expectedErr := errors.New("expected error")
+
+	// Fail the put of every entity with an odd IntVal.
+	nds.SetDatastorePutMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		me, isErr := make(appengine.MultiError, len(keys)), false
+		for i, val := range vals.([]testEntity) {
+			if val.IntVal%2 == 1 {
+				me[i] = expectedErr
+				isErr = true
+			}
+		}
+		if isErr {
+			return nil, me
+		}
+		return datastore.PutMulti(c, keys, vals)
+	})
+
+	defer func() {
+		nds.SetDatastorePutMulti(datastore.PutMulti)
+	}()
+
+	// The last batch contains no errors.
+	count := 1001
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := 0; i < count; i++ {
+		keys = append(keys, datastore.NewKey(c, "Test", "", int64(i+1), nil))
+		if i < 1000 {
+			entities = append(entities, testEntity{i})
+		} else {
+			entities = append(entities, testEntity{0})
+		}
+	}
+
+	_, err = nds.PutMulti(c, keys, entities)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if len(me) != count {
+		t.Fatal("incorrect length appengine.MultiError", len(me))
+	}
+	for i, e := range me {
+		if i < 1000 && i%2 == 1 {
+			if e != expectedErr {
+				t.Fatalf("expected error at index %d", i)
+			}
+		} else if e != nil {
+			t.Fatalf("unexpected error at index %d: %s", i, e)
+		}
+	}
+}
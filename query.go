@@ -0,0 +1,266 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// GetAll runs the query q and returns all the keys that match it. If dst is
+// not nil, the matching entities are also loaded into dst, which must be a
+// *[]S, *[]*S or *[]P, for some struct type S or some non-interface,
+// non-pointer type P such that P or *P implements
+// datastore.PropertyLoadSaver. Loaded entities are appended to dst, like
+// datastore.Query.GetAll.
+//
+// The query itself is executed keys only and the entities are then loaded
+// through nds.GetMulti, so they are served from memcache where possible with
+// the same consistency guarantees. Entities that have been deleted since the
+// query index was last updated are omitted from the results.
+//
+// q must not be a projection query. If q is a keys only query dst should be
+// nil.
+//
+// As with datastore.Query.GetAll, if a field mismatch occurs the remaining
+// entities are still loaded and the first *datastore.ErrFieldMismatch is
+// returned.
+func GetAll(c appengine.Context,
+	q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return defaultClient.GetAll(c, q, dst)
+}
+
+// GetAll works like the package level GetAll using the Client's Options.
+func (cl *Client) GetAll(c appengine.Context,
+	q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+
+	if dst == nil {
+		return q.KeysOnly().GetAll(c, nil)
+	}
+
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	dv = dv.Elem()
+	if dv.Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	if err := checkQueryElemType(dv.Type().Elem()); err != nil {
+		return nil, err
+	}
+
+	keys, err := q.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := newQueryVals(dv.Type(), len(keys))
+
+	var errFieldMismatch error
+	if err := cl.GetMulti(c, keys, vals.Interface()); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return nil, err
+		}
+
+		foundKeys := make([]*datastore.Key, 0, len(keys))
+		foundVals := reflect.MakeSlice(vals.Type(), 0, len(keys))
+		for i, err := range me {
+			switch err.(type) {
+			case nil:
+			case *datastore.ErrFieldMismatch:
+				if errFieldMismatch == nil {
+					errFieldMismatch = err
+				}
+			default:
+				if err == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return nil, err
+			}
+			foundKeys = append(foundKeys, keys[i])
+			foundVals = reflect.Append(foundVals, vals.Index(i))
+		}
+		keys, vals = foundKeys, foundVals
+	}
+
+	dv.Set(reflect.AppendSlice(dv, vals))
+	return keys, errFieldMismatch
+}
+
+func checkQueryElemType(elemType reflect.Type) error {
+	if reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) {
+		return nil
+	}
+
+	switch elemType.Kind() {
+	case reflect.Struct:
+		return nil
+	case reflect.Ptr:
+		if elemType.Elem().Kind() == reflect.Struct {
+			return nil
+		}
+	}
+	return errors.New("nds: unsupported dst type")
+}
+
+// newQueryVals creates a slice of type sliceType and length n that can be
+// passed to GetMulti. Struct pointer elements are allocated so that each one
+// is a valid destination.
+func newQueryVals(sliceType reflect.Type, n int) reflect.Value {
+	vals := reflect.MakeSlice(sliceType, n, n)
+	if elemType := sliceType.Elem(); elemType.Kind() == reflect.Ptr {
+		for i := 0; i < n; i++ {
+			vals.Index(i).Set(reflect.New(elemType.Elem()))
+		}
+	}
+	return vals
+}
+
+// iteratorBatchSize is the number of keys Iterator.Next reads ahead from the
+// keys only query so that their entities can be loaded with one GetMulti.
+const iteratorBatchSize = 50
+
+// Iterator is the result of running a query with nds.Run.
+type Iterator struct {
+	cl *Client
+	c  appengine.Context
+	q  *datastore.Query
+	t  *datastore.Iterator
+
+	// batch holds the keys read ahead from t and, once loaded, their
+	// entities. pos is the index of the next result to return from it.
+	batch  []iteratorResult
+	pos    int
+	loaded bool
+
+	// start is the cursor for the start of batch.
+	start    datastore.Cursor
+	startErr error
+
+	// err is the error, usually datastore.Done, that ended t.
+	err error
+}
+
+type iteratorResult struct {
+	key *datastore.Key
+	pl  datastore.PropertyList
+	err error
+}
+
+// Run runs the query q in the given context. The query is executed keys only.
+// Iterator.Next reads up to 50 keys ahead and loads their entities with one
+// nds.GetMulti call the first time it is given a dst for them.
+func Run(c appengine.Context, q *datastore.Query) *Iterator {
+	return defaultClient.Run(c, q)
+}
+
+// Run works like the package level Run using the Client's Options.
+func (cl *Client) Run(c appengine.Context, q *datastore.Query) *Iterator {
+	q = q.KeysOnly()
+	return &Iterator{
+		cl: cl,
+		c:  c,
+		q:  q,
+		t:  q.Run(c),
+	}
+}
+
+// Next returns the key of the next result. When there are no more results,
+// datastore.Done is returned as the error.
+//
+// If dst is not nil the entity is also loaded into dst, which must be a
+// struct pointer or implement datastore.PropertyLoadSaver. Entities that have
+// been deleted since the query index was last updated are skipped.
+func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	for {
+		if t.pos == len(t.batch) {
+			if t.err != nil {
+				return nil, t.err
+			}
+			t.readBatch()
+			continue
+		}
+
+		if dst != nil && !t.loaded {
+			t.loadBatch()
+		}
+
+		result := t.batch[t.pos]
+		t.pos++
+
+		if dst == nil {
+			return result.key, nil
+		}
+
+		if result.err == datastore.ErrNoSuchEntity {
+			continue
+		} else if result.err != nil {
+			return result.key, result.err
+		}
+
+		if pl, ok := dst.(*datastore.PropertyList); ok && pl == nil {
+			return result.key, datastore.ErrInvalidEntityType
+		}
+
+		// dst is loaded through an interface value, as it is when it is
+		// passed to Get.
+		return result.key, setValue(reflect.ValueOf(&dst).Elem(), result.pl)
+	}
+}
+
+// readBatch reads the next batch of keys from the keys only iterator.
+func (t *Iterator) readBatch() {
+	t.start, t.startErr = t.t.Cursor()
+	t.batch = make([]iteratorResult, 0, iteratorBatchSize)
+	t.pos = 0
+	t.loaded = false
+
+	for len(t.batch) < iteratorBatchSize {
+		key, err := t.t.Next(nil)
+		if err != nil {
+			t.err = err
+			return
+		}
+		t.batch = append(t.batch, iteratorResult{key: key})
+	}
+}
+
+// loadBatch loads the entities of the results in the batch that have not been
+// returned yet.
+func (t *Iterator) loadBatch() {
+	results := t.batch[t.pos:]
+	keys := make([]*datastore.Key, len(results))
+	for i, result := range results {
+		keys[i] = result.key
+	}
+	pls := make([]datastore.PropertyList, len(results))
+
+	err := t.cl.GetMulti(t.c, keys, pls)
+	me, ok := err.(appengine.MultiError)
+	for i := range results {
+		results[i].pl = pls[i]
+		if ok {
+			results[i].err = me[i]
+		} else {
+			results[i].err = err
+		}
+	}
+	t.loaded = true
+}
+
+// Cursor returns a cursor for the iterator's current location.
+//
+// When the iterator is part way through a batch of keys it has read ahead,
+// the cursor is found by running the query again from the start of the batch.
+func (t *Iterator) Cursor() (datastore.Cursor, error) {
+	if t.pos == len(t.batch) {
+		return t.t.Cursor()
+	}
+	if t.pos == 0 || t.startErr != nil {
+		return t.start, t.startErr
+	}
+	return t.q.Start(t.start).Offset(t.pos).Limit(0).Run(t.c).Cursor()
+}
@@ -0,0 +1,99 @@
+package nds
+
+import (
+	"sync"
+)
+
+// Stats holds counters of how entities were got by nds.GetMulti. The counters
+// are kept in memory by each app instance since it started or since
+// ResetStats was last called.
+type Stats struct {
+	// LocalHits is the number of entities found in a context cache created
+	// with NewContext.
+	LocalHits uint64
+
+	// Hits is the number of entities, or missing entities, found in the
+	// cache.
+	Hits uint64
+
+	// Misses is the number of entities not found in the cache.
+	Misses uint64
+
+	// InternalLocks is the number of cache misses that were locked by the
+	// request so that the cache could be refreshed from the datastore.
+	InternalLocks uint64
+
+	// ExternalLocks is the number of entities read from the datastore without
+	// refreshing the cache, either because another request held the lock or
+	// because the cache could not be used.
+	ExternalLocks uint64
+
+	// LockWaits is the number of times the cache was polled again for an
+	// entity locked by another request. See Options.LockWait.
+	LockWaits uint64
+
+	// UnmarshalErrors is the number of cached entities that could not be
+	// unmarshaled. They are replaced in the cache by the entity read from the
+	// datastore.
+	UnmarshalErrors uint64
+
+	// SetValueErrors is the number of cached entities that could not be
+	// loaded into the destination value.
+	SetValueErrors uint64
+
+	// DatastoreGets is the number of entities read from the datastore.
+	DatastoreGets uint64
+}
+
+func (s *Stats) add(o Stats) {
+	s.LocalHits += o.LocalHits
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.InternalLocks += o.InternalLocks
+	s.ExternalLocks += o.ExternalLocks
+	s.LockWaits += o.LockWaits
+	s.UnmarshalErrors += o.UnmarshalErrors
+	s.SetValueErrors += o.SetValueErrors
+	s.DatastoreGets += o.DatastoreGets
+}
+
+var (
+	kindStatsMutex sync.Mutex
+	kindStats      = map[string]*Stats{}
+)
+
+// ReadStats returns a snapshot of the counters of this app instance by entity
+// kind.
+func ReadStats() map[string]Stats {
+	kindStatsMutex.Lock()
+	defer kindStatsMutex.Unlock()
+
+	snapshot := make(map[string]Stats, len(kindStats))
+	for kind, stats := range kindStats {
+		snapshot[kind] = *stats
+	}
+	return snapshot
+}
+
+// ResetStats sets all the counters of this app instance to zero.
+func ResetStats() {
+	kindStatsMutex.Lock()
+	defer kindStatsMutex.Unlock()
+
+	kindStats = map[string]*Stats{}
+}
+
+func addStats(cacheItems []cacheItem) {
+	kindStatsMutex.Lock()
+	defer kindStatsMutex.Unlock()
+
+	for _, cacheItem := range cacheItems {
+		kind := cacheItem.key.Kind()
+		stats, ok := kindStats[kind]
+		if !ok {
+			stats = &Stats{}
+			kindStats[kind] = stats
+		}
+		stats.add(cacheItem.stats)
+	}
+}
@@ -0,0 +1,109 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestStats(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.ResetStats()
+	defer nds.ResetStats()
+
+	key := datastore.NewKey(c, "StatsEntity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore then from cache.
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(c, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := nds.ReadStats()["StatsEntity"]
+	expected := nds.Stats{
+		Hits:          1,
+		Misses:        1,
+		InternalLocks: 1,
+		DatastoreGets: 1,
+	}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	// Unmarshal failure.
+	nds.SetUnmarshal(func(data []byte, pl *datastore.PropertyList) error {
+		return errors.New("expected error")
+	})
+	err = nds.Get(c, key, &testEntity{})
+	nds.SetUnmarshal(nds.UnmarshalPropertyList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats = nds.ReadStats()["StatsEntity"]
+	if stats.UnmarshalErrors != 1 {
+		t.Fatal("expected 1 unmarshal error", stats.UnmarshalErrors)
+	}
+	if stats.InternalLocks != 2 {
+		t.Fatal("expected 2 internal locks", stats.InternalLocks)
+	}
+	if stats.DatastoreGets != 2 {
+		t.Fatal("expected 2 datastore gets", stats.DatastoreGets)
+	}
+
+	// Lock held by another request.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(c, key),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats = nds.ReadStats()["StatsEntity"]
+	if stats.ExternalLocks != 1 {
+		t.Fatal("expected 1 external lock", stats.ExternalLocks)
+	}
+
+	// Context cache hit.
+	lc := nds.NewContext(c)
+	if err := memcache.Delete(c, nds.CreateMemcacheKey(c, key)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(lc, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats = nds.ReadStats()["StatsEntity"]
+	if stats.LocalHits != 1 {
+		t.Fatal("expected 1 local hit", stats.LocalHits)
+	}
+
+	nds.ResetStats()
+	if len(nds.ReadStats()) != 0 {
+		t.Fatal("expected stats to be reset")
+	}
+}
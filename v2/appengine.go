@@ -0,0 +1,36 @@
+package nds
+
+import (
+	"context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// AppEngineDatastore is the default Datastore. It uses the App Engine
+// datastore service.
+type AppEngineDatastore struct{}
+
+// GetMulti is a batch version of datastore.Get.
+func (AppEngineDatastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+	return datastoreGetMulti(c, keys, vals)
+}
+
+// PutMulti is a batch version of datastore.Put.
+func (AppEngineDatastore) PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	return datastorePutMulti(c, keys, vals)
+}
+
+// DeleteMulti is a batch version of datastore.Delete.
+func (AppEngineDatastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+	return datastoreDeleteMulti(c, keys)
+}
+
+// RunInTransaction runs f in a datastore transaction.
+func (AppEngineDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(c, f, opts)
+}
@@ -0,0 +1,194 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// mapCache is an in process nds.Cache used to test custom cache backends.
+type mapCache struct {
+	sync.Mutex
+	items   map[string]nds.Item
+	version map[string]int
+	counter int
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{
+		items:   map[string]nds.Item{},
+		version: map[string]int{},
+	}
+}
+
+func (m *mapCache) set(item *nds.Item) {
+	m.counter++
+	m.items[item.Key] = *item
+	m.version[item.Key] = m.counter
+}
+
+func (m *mapCache) AddMulti(c context.Context, items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+
+	me, isErr := make(appengine.MultiError, len(items)), false
+	for i, item := range items {
+		if _, ok := m.items[item.Key]; ok {
+			me[i] = memcache.ErrNotStored
+			isErr = true
+			continue
+		}
+		m.set(item)
+	}
+	if isErr {
+		return me
+	}
+	return nil
+}
+
+func (m *mapCache) CompareAndSwapMulti(c context.Context,
+	items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+
+	me, isErr := make(appengine.MultiError, len(items)), false
+	for i, item := range items {
+		if version, ok := m.version[item.Key]; !ok {
+			me[i] = memcache.ErrNotStored
+			isErr = true
+		} else if version != item.GetCASInfo().(int) {
+			me[i] = memcache.ErrCASConflict
+			isErr = true
+		} else {
+			m.set(item)
+		}
+	}
+	if isErr {
+		return me
+	}
+	return nil
+}
+
+func (m *mapCache) DeleteMulti(c context.Context, keys []string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, key := range keys {
+		delete(m.items, key)
+		delete(m.version, key)
+	}
+	return nil
+}
+
+func (m *mapCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	items := make(map[string]*nds.Item, len(keys))
+	for _, key := range keys {
+		if item, ok := m.items[key]; ok {
+			item.SetCASInfo(m.version[key])
+			items[key] = &item
+		}
+	}
+	return items, nil
+}
+
+func (m *mapCache) SetMulti(c context.Context, items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, item := range items {
+		m.set(item)
+	}
+	return nil
+}
+
+func TestSetCache(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	mc := newMapCache()
+	nds.SetCache(mc)
+	defer nds.SetCache(nds.Memcache{})
+
+	// App Engine memcache should never be used.
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		return nil, errors.New("unexpected memcache call")
+	})
+	defer nds.SetMemcacheGetMulti(nds.ZeroMemcacheGetMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore and populate the cache.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	item, ok := mc.items[nds.CreateMemcacheKey(c, key)]
+	if !ok {
+		t.Fatal("expected entity to be cached")
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item flag", item.Flags)
+	}
+
+	// Get from cache.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		return errors.New("expected cache hit")
+	})
+	te = &testEntity{}
+	err = nds.Get(c, key, te)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// The entity should remain locked after the delete.
+	item, ok = mc.items[nds.CreateMemcacheKey(c, key)]
+	if !ok {
+		t.Fatal("expected lock item")
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected lock item flag", item.Flags)
+	}
+}
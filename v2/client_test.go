@@ -0,0 +1,295 @@
+package nds_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestNewClientInvalidOptions(t *testing.T) {
+	tests := []nds.Options{
+		{LockTime: -time.Second},
+		{LockWait: -time.Second},
+		{CompressionMinSize: -1},
+		{GetMultiLimit: 1001},
+		{PutMultiLimit: -1},
+		{DeleteMultiLimit: 501},
+		{Marshal: nds.MarshalPropertyList},
+		{Unmarshal: nds.UnmarshalPropertyList},
+	}
+	for i, opts := range tests {
+		if _, err := nds.NewClient(opts); err == nil {
+			t.Fatal("expected error for test", i)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lockTime := 5 * time.Second
+	mutex := sync.Mutex{}
+	marshals, unmarshals := 0, 0
+	cl, err := nds.NewClient(nds.Options{
+		LockTime:         lockTime,
+		Prefix:           "TEST:",
+		GetMultiLimit:    2,
+		PutMultiLimit:    2,
+		DeleteMultiLimit: 2,
+		Marshal: func(pl datastore.PropertyList) ([]byte, error) {
+			mutex.Lock()
+			marshals++
+			mutex.Unlock()
+			return nds.MarshalPropertyList(pl)
+		},
+		Unmarshal: func(data []byte, pl *datastore.PropertyList) error {
+			mutex.Lock()
+			unmarshals++
+			mutex.Unlock()
+			return nds.UnmarshalPropertyList(data, pl)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := 1; i < 6; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", int64(i), nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	lockExpirations := []time.Duration{}
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		mutex.Lock()
+		for _, item := range items {
+			if item.Flags == nds.LockItem {
+				lockExpirations = append(lockExpirations, item.Expiration)
+			}
+		}
+		mutex.Unlock()
+		return nds.ZeroMemcacheSetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(nds.ZeroMemcacheSetMulti)
+
+	putCalls := 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		mutex.Lock()
+		putCalls++
+		mutex.Unlock()
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	if _, err := cl.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if putCalls != 3 {
+		t.Fatal("expected 3 datastore puts", putCalls)
+	}
+	if len(lockExpirations) != len(keys) {
+		t.Fatal("expected a lock for each key", len(lockExpirations))
+	}
+	for _, exp := range lockExpirations {
+		if exp != lockTime {
+			t.Fatal("expected lock time", lockTime, "got", exp)
+		}
+	}
+
+	// Load the cache and then use it.
+	for i := 0; i < 2; i++ {
+		getEntities := make([]testEntity, len(keys))
+		if err := cl.GetMulti(c, keys, getEntities); err != nil {
+			t.Fatal(err)
+		}
+		for j, e := range entities {
+			if e != getEntities[j] {
+				t.Fatal("expected", e, "got", getEntities[j])
+			}
+		}
+	}
+	if marshals != len(keys) || unmarshals != len(keys) {
+		t.Fatal("expected client codec to be used", marshals, unmarshals)
+	}
+
+	memcacheKey := cl.CreateMemcacheKey(c, keys[0])
+	if !strings.HasPrefix(memcacheKey, "TEST:") {
+		t.Fatal("expected prefix", memcacheKey)
+	}
+	if _, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The default client does not share the client's cache.
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(c, keys[0])); err != memcache.ErrCacheMiss {
+		t.Fatal("expected cache miss", err)
+	}
+
+	if err := cl.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	err = cl.Get(c, keys[0], &testEntity{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity", err)
+	}
+}
+
+func TestClientCacheOptions(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		StrVal string
+	}
+
+	// The package level settings do not change Clients.
+	nds.SetWriteThrough(true)
+	defer nds.SetWriteThrough(false)
+	nds.SetKindPolicy("ClientOptionsEntity", nds.Policy{NoCache: true})
+	defer nds.SetKindPolicy("ClientOptionsEntity", nds.Policy{})
+
+	key := datastore.NewKey(c, "ClientOptionsEntity", "", 1, nil)
+	entity := &testEntity{strings.Repeat("a", 1000)}
+
+	cl, err := nds.NewClient(nds.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := cl.CreateMemcacheKey(c, key)
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected put not to write through", err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity to be cached", item.Flags)
+	}
+
+	// Clients use their own settings.
+	cl, err = nds.NewClient(nds.Options{
+		WriteThrough:       true,
+		CacheNewEntities:   true,
+		CompressionMinSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.CompressedEntityItem {
+		t.Fatal("expected compressed entity to be written through",
+			item.Flags)
+	}
+
+	newKey, err := cl.Put(c,
+		datastore.NewIncompleteKey(c, "ClientOptionsEntity", nil), entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c,
+		cl.CreateMemcacheKey(c, newKey)); err != nil {
+		t.Fatal("expected new entity to be cached", err)
+	}
+
+	cl, err = nds.NewClient(nds.Options{
+		KindPolicies: map[string]nds.Policy{
+			"ClientOptionsEntity": {NoCache: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected entity not to be cached", err)
+	}
+}
+
+func TestClientTransaction(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lockTime := 5 * time.Second
+	cl, err := nds.NewClient(nds.Options{
+		LockTime: lockTime,
+		Prefix:   "TEST:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locks := []*memcache.Item{}
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Flags == nds.LockItem {
+				locks = append(locks, item)
+			}
+		}
+		return nds.ZeroMemcacheSetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(nds.ZeroMemcacheSetMulti)
+
+	// Package level writes in the transaction are locked by the client.
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if err := cl.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{1})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(locks) != 1 {
+		t.Fatal("expected 1 lock", len(locks))
+	}
+	if !strings.HasPrefix(locks[0].Key, "TEST:") {
+		t.Fatal("expected client prefix", locks[0].Key)
+	}
+	if locks[0].Expiration != lockTime {
+		t.Fatal("expected lock time", lockTime, "got", locks[0].Expiration)
+	}
+}
@@ -0,0 +1,209 @@
+package nds_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func codecPropertyList(c context.Context) datastore.PropertyList {
+	parent := datastore.NewKey(c, "Parent", "name", 0, nil)
+	return datastore.PropertyList{
+		datastore.Property{Name: "Nil"},
+		datastore.Property{Name: "Int", Value: int64(-12345)},
+		datastore.Property{Name: "Bool", Value: true, NoIndex: true},
+		datastore.Property{Name: "String", Value: "value", Multiple: true},
+		datastore.Property{Name: "String", Value: "other", Multiple: true},
+		datastore.Property{Name: "Float", Value: 3.25},
+		datastore.Property{Name: "Key",
+			Value: datastore.NewKey(c, "Child", "", 7, parent)},
+		datastore.Property{Name: "NilKey", Value: (*datastore.Key)(nil)},
+		datastore.Property{Name: "Time",
+			Value: time.Unix(1234567890, 123456789)},
+		datastore.Property{Name: "BlobKey", Value: appengine.BlobKey("blob"),
+			NoIndex: true},
+		datastore.Property{Name: "GeoPoint",
+			Value: appengine.GeoPoint{Lat: 1.5, Lng: -2.5}},
+		datastore.Property{Name: "Bytes", Value: []byte{0, 1, 2},
+			NoIndex: true},
+		datastore.Property{Name: "ByteString",
+			Value: datastore.ByteString("bytes")},
+		datastore.Property{Name: "Entity", Value: &datastore.Entity{
+			Key: datastore.NewKey(c, "Nested", "nested", 0, parent),
+			Properties: []datastore.Property{
+				{Name: "Int", Value: int64(1)},
+				{Name: "Time", Value: time.Unix(1234567890, 0),
+					NoIndex: true},
+				{Name: "Entity", Value: &datastore.Entity{
+					Properties: []datastore.Property{
+						{Name: "String", Value: "deep", Multiple: true},
+					},
+				}},
+			},
+		}},
+		datastore.Property{Name: "EmptyEntity", Value: &datastore.Entity{}},
+	}
+}
+
+func checkCodecPropertyList(t *testing.T,
+	expected, actual datastore.PropertyList) {
+
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d properties, got %d", len(expected), len(actual))
+	}
+	for i, e := range expected {
+		a := actual[i]
+		if e.Name != a.Name || e.NoIndex != a.NoIndex ||
+			e.Multiple != a.Multiple {
+			t.Fatalf("property %d: expected %+v, got %+v", i, e, a)
+		}
+
+		switch ev := e.Value.(type) {
+		case *datastore.Key:
+			av, ok := a.Value.(*datastore.Key)
+			if !ok {
+				t.Fatalf("property %d: expected key, got %T", i, a.Value)
+			}
+			if (ev == nil) != (av == nil) || (ev != nil && !ev.Equal(av)) {
+				t.Fatalf("property %d: expected %v, got %v", i, ev, av)
+			}
+		case *datastore.Entity:
+			av, ok := a.Value.(*datastore.Entity)
+			if !ok {
+				t.Fatalf("property %d: expected entity, got %T", i, a.Value)
+			}
+			if (ev.Key == nil) != (av.Key == nil) ||
+				(ev.Key != nil && !ev.Key.Equal(av.Key)) {
+				t.Fatalf("property %d: expected key %v, got %v",
+					i, ev.Key, av.Key)
+			}
+			checkCodecPropertyList(t, ev.Properties, av.Properties)
+		case time.Time:
+			av, ok := a.Value.(time.Time)
+			if !ok || !ev.Equal(av) {
+				t.Fatalf("property %d: expected %v, got %v", i, ev, a.Value)
+			}
+		default:
+			if !reflect.DeepEqual(e.Value, a.Value) {
+				t.Fatalf("property %d: expected %#v, got %#v",
+					i, e.Value, a.Value)
+			}
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	pl := codecPropertyList(c)
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkCodecPropertyList(t, pl, decoded)
+
+	// Times are decoded in UTC like those loaded from the datastore.
+	for _, p := range decoded {
+		if tm, ok := p.Value.(time.Time); ok && tm.Location() != time.UTC {
+			t.Fatal("expected UTC time", tm.Location())
+		}
+	}
+
+	// Property lists without entity values are encoded as version 1 so that
+	// github.com/qedus/nds can decode them.
+	if data[1] != 2 {
+		t.Fatal("expected version 2", data[1])
+	}
+	data, err = nds.MarshalPropertyList(pl[:len(pl)-2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[1] != 1 {
+		t.Fatal("expected version 1", data[1])
+	}
+	decoded = datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkCodecPropertyList(t, pl[:len(pl)-2], decoded)
+
+	// Empty property lists are valid entities.
+	data, err = nds.MarshalPropertyList(datastore.PropertyList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 0 {
+		t.Fatal("expected no properties")
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	data, err := nds.MarshalPropertyList(codecPropertyList(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data in other formats.
+	pl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList([]byte{0x1f, 0xff}, &pl); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Unknown version.
+	unknown := append([]byte{}, data...)
+	unknown[1] = 0xff
+	pl = datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(unknown, &pl); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Entity values are not part of version 1.
+	entity, err := nds.MarshalPropertyList(datastore.PropertyList{
+		{Name: "Entity", Value: &datastore.Entity{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity[1] = 1
+	pl = datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(entity, &pl); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Truncated data.
+	for i := 1; i < len(data); i++ {
+		pl := datastore.PropertyList{}
+		if err := nds.UnmarshalPropertyList(data[:i], &pl); err == nil {
+			t.Fatal("expected error for length", i)
+		}
+		if len(pl) != 0 {
+			t.Fatal("expected no properties for length", i)
+		}
+	}
+}
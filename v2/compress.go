@@ -0,0 +1,85 @@
+package nds
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// SetCompression enables flate compression of the entities cached by the
+// package level functions whose marshaled size is at least minSize bytes.
+// Compressed entities are only stored if they are smaller than the
+// uncompressed entity. A minSize of zero or less disables compression, which
+// is the default. Entities already cached are readable whether or not
+// compression is enabled. Clients use the CompressionMinSize of their Options.
+//
+// It is not safe to call SetCompression concurrently with other nds functions
+// so it should be called once during app initialisation.
+func SetCompression(minSize int) {
+	if minSize < 0 {
+		minSize = 0
+	}
+	defaultClient.opts.CompressionMinSize = minSize
+}
+
+// marshalEntity marshals pl and, if it is large enough, compresses it. It
+// returns the item flags the value should be cached with.
+func (cl *Client) marshalEntity(
+	pl datastore.PropertyList) ([]byte, uint32, error) {
+
+	data, err := cl.marshal(pl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	minSize := cl.opts.CompressionMinSize
+	if minSize == 0 || len(data) < minSize {
+		return data, entityItem, nil
+	}
+
+	compressed, err := compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) >= len(data) {
+		return data, entityItem, nil
+	}
+	return compressed, compressedEntityItem, nil
+}
+
+// unmarshalEntity unmarshals an entityItem or compressedEntityItem into pl.
+func (cl *Client) unmarshalEntity(item *Item,
+	pl *datastore.PropertyList) error {
+
+	data := item.Value
+	if item.Flags == compressedEntityItem {
+		var err error
+		if data, err = decompress(data); err != nil {
+			return err
+		}
+	}
+	return cl.unmarshal(data, pl)
+}
+
+func compress(data []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,178 @@
+package nds
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// contextKey is the type of the keys nds stores its context values under.
+type contextKey int
+
+const (
+	localContextKey contextKey = iota
+	transactionContextKey
+)
+
+// localContext caches entities in process for the lifetime of the context it
+// is stored in. See NewContext.
+type localContext struct {
+	sync.Mutex
+	entities map[string]localEntity
+
+	// evicted records the version at which each local cache key was last
+	// evicted and cleared the version at which all of them were last
+	// evicted. They ensure that gets which started before a put or delete
+	// completed cannot save a stale entity back to the local cache.
+	evicted map[string]uint64
+	cleared uint64
+	version uint64
+}
+
+type localEntity struct {
+	pl  datastore.PropertyList
+	err error
+}
+
+// NewContext returns a copy of c that caches entities in process, similar to
+// the Python ndb context cache. nds.Get and nds.GetMulti called with the
+// returned context will check the local cache before memcache and nds puts and
+// deletes, including those within nds.RunInTransaction, will evict the entities
+// they touch.
+//
+// The returned context should be created once per request and not shared
+// between requests. It is usually created from the context returned by
+// appengine.NewContext. Contexts derived from it, for example with
+// appengine.Namespace or context.WithTimeout, share its local cache.
+func NewContext(c context.Context) context.Context {
+	if _, ok := localCacheContext(c); ok {
+		return c
+	}
+
+	// Transactions never use the local cache.
+	if _, ok := transactionContext(c); ok {
+		return c
+	}
+
+	return context.WithValue(c, localContextKey, &localContext{
+		entities: make(map[string]localEntity),
+		evicted:  make(map[string]uint64),
+	})
+}
+
+// localCacheContext returns the local cache of c. Transactions never use the
+// local cache even if their context was derived from one.
+func localCacheContext(c context.Context) (*localContext, bool) {
+	if _, ok := transactionContext(c); ok {
+		return nil, false
+	}
+	lc, ok := c.Value(localContextKey).(*localContext)
+	return lc, ok && lc != nil
+}
+
+// withoutLocalCache returns a copy of c that does not use a local cache.
+func withoutLocalCache(c context.Context) context.Context {
+	if _, ok := localCacheContext(c); !ok {
+		return c
+	}
+	return context.WithValue(c, localContextKey, (*localContext)(nil))
+}
+
+// load sets the values of any cacheItems found in the local cache. It returns
+// the version that must be passed to save.
+func (lc *localContext) load(c context.Context, cacheItems []cacheItem) uint64 {
+	lc.Lock()
+	defer lc.Unlock()
+
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+
+		le, ok := lc.entities[cacheItem.localCacheKey]
+		if !ok {
+			continue
+		}
+
+		if le.err != nil {
+			cacheItems[i].state = done
+			cacheItems[i].err = le.err
+			cacheItems[i].stats.LocalHits++
+			continue
+		}
+
+		if err := setValue(cacheItems[i].val, le.pl); err == nil {
+			cacheItems[i].state = done
+			cacheItems[i].pl = le.pl
+			cacheItems[i].stats.LocalHits++
+		} else {
+			logger.Warningf(c, "nds:localContext setValue %s", err)
+		}
+	}
+	return lc.version
+}
+
+// save adds the entities in cacheItems to the local cache unless they have
+// been evicted since version.
+func (lc *localContext) save(version uint64, cacheItems []cacheItem) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	for _, cacheItem := range cacheItems {
+		if cacheItem.policy.NoCache || lc.cleared > version ||
+			lc.evicted[cacheItem.localCacheKey] > version {
+			continue
+		}
+
+		switch {
+		case cacheItem.err == datastore.ErrNoSuchEntity:
+			lc.entities[cacheItem.localCacheKey] = localEntity{
+				err: datastore.ErrNoSuchEntity,
+			}
+		case cacheItem.err == nil && cacheItem.pl != nil:
+			lc.entities[cacheItem.localCacheKey] = localEntity{
+				pl: cacheItem.pl,
+			}
+		}
+	}
+}
+
+// evict removes localCacheKeys from the local cache.
+func (lc *localContext) evict(localCacheKeys []string) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	lc.version++
+	for _, localCacheKey := range localCacheKeys {
+		delete(lc.entities, localCacheKey)
+		lc.evicted[localCacheKey] = lc.version
+	}
+}
+
+// evictAll removes every entity from the local cache.
+func (lc *localContext) evictAll() {
+	lc.Lock()
+	defer lc.Unlock()
+
+	lc.version++
+	lc.entities = make(map[string]localEntity)
+	lc.evicted = make(map[string]uint64)
+	lc.cleared = lc.version
+}
+
+// localCacheKey returns the key that key is cached under in a local cache.
+// Unlike memcache keys it does not include the generations so local cache
+// hits do not need any memcache calls. The prefix keeps the entities of
+// Clients with different prefixes apart.
+func (cl *Client) localCacheKey(key *datastore.Key) string {
+	return cl.prefix() + key.Encode()
+}
+
+func (cl *Client) localCacheKeys(keys []*datastore.Key) []string {
+	localCacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		localCacheKeys[i] = cl.localCacheKey(key)
+	}
+	return localCacheKeys
+}
@@ -0,0 +1,50 @@
+package nds
+
+import (
+	"context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Datastore is the interface nds uses to reach the datastore. The default is
+// AppEngineDatastore, which uses the App Engine datastore service. Other
+// implementations, such as an in-memory store, can be used by calling
+// SetDatastore. Keys are google.golang.org/appengine/datastore keys, which can
+// only be made with an App Engine context, so nds still has to run on App
+// Engine and an implementation that fronts another datastore client has to
+// convert them.
+//
+// nds relies on the following semantics to keep the cache strongly
+// consistent:
+//
+// GetMulti, PutMulti and DeleteMulti must behave like their
+// google.golang.org/appengine/datastore equivalents. vals is a slice accepted
+// by datastore.GetMulti and datastore.PutMulti. Per entity failures should be
+// returned as an appengine.MultiError and missing entities as
+// datastore.ErrNoSuchEntity. Methods may be called with no keys and should
+// return quickly in that case.
+//
+// RunInTransaction must call f with a context derived from c. Calls made with
+// that context, or any context derived from it, must be part of the
+// transaction. RunInTransaction may call f more than once and must only return
+// nil once the transaction has committed.
+//
+// Queries are not part of the interface. nds.GetAll and nds.Run always run
+// their keys only query on the App Engine datastore service.
+type Datastore interface {
+	GetMulti(c context.Context, keys []*datastore.Key, vals interface{}) error
+	PutMulti(c context.Context, keys []*datastore.Key,
+		vals interface{}) ([]*datastore.Key, error)
+	DeleteMulti(c context.Context, keys []*datastore.Key) error
+	RunInTransaction(c context.Context, f func(tc context.Context) error,
+		opts *datastore.TransactionOptions) error
+}
+
+var datastoreBackend Datastore = AppEngineDatastore{}
+
+// SetDatastore sets the Datastore used by nds. It is not safe to call
+// SetDatastore concurrently with other nds functions so it should be called
+// once during app initialisation.
+func SetDatastore(ds Datastore) {
+	datastoreBackend = ds
+}
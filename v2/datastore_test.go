@@ -0,0 +1,242 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+// mapDatastore is an in process nds.Datastore used to test custom datastore
+// backends. It only supports struct pointer and datastore.PropertyList values.
+type mapDatastore struct {
+	sync.Mutex
+	entities map[string]datastore.PropertyList
+	getCount int
+}
+
+type mapTransactionKey struct{}
+
+// mapTransaction buffers the writes of a transaction. A nil entity means the
+// entity was deleted.
+type mapTransaction struct {
+	sync.Mutex
+	entities map[string]datastore.PropertyList
+}
+
+func newMapDatastore() *mapDatastore {
+	return &mapDatastore{
+		entities: map[string]datastore.PropertyList{},
+	}
+}
+
+func saveEntity(val reflect.Value) (datastore.PropertyList, error) {
+	if pl, ok := val.Interface().(datastore.PropertyList); ok {
+		return pl, nil
+	}
+	pl := datastore.PropertyList{}
+	err := nds.SaveStruct(val.Interface(), &pl)
+	return pl, err
+}
+
+func loadEntity(val reflect.Value, pl datastore.PropertyList) error {
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if _, ok := val.Interface().(datastore.PropertyList); ok {
+		val.Set(reflect.ValueOf(pl))
+		return nil
+	}
+	return nds.LoadStruct(val.Interface(), pl)
+}
+
+func (m *mapDatastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.getCount++
+
+	v := reflect.ValueOf(vals)
+	errs := make(appengine.MultiError, len(keys))
+	errsNil := true
+	for i, key := range keys {
+		pl, ok := m.entities[key.Encode()]
+		if !ok {
+			errs[i], errsNil = datastore.ErrNoSuchEntity, false
+			continue
+		}
+		if err := loadEntity(v.Index(i), pl); err != nil {
+			errs[i], errsNil = err, false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+func (m *mapDatastore) PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+
+	v := reflect.ValueOf(vals)
+	pls := make([]datastore.PropertyList, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() {
+			return nil, errors.New("incomplete keys not supported")
+		}
+		pl, err := saveEntity(v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		pls[i] = pl
+	}
+
+	if tx, ok := c.Value(mapTransactionKey{}).(*mapTransaction); ok {
+		tx.Lock()
+		for i, key := range keys {
+			tx.entities[key.Encode()] = pls[i]
+		}
+		tx.Unlock()
+		return keys, nil
+	}
+
+	m.Lock()
+	for i, key := range keys {
+		m.entities[key.Encode()] = pls[i]
+	}
+	m.Unlock()
+	return keys, nil
+}
+
+func (m *mapDatastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+
+	if tx, ok := c.Value(mapTransactionKey{}).(*mapTransaction); ok {
+		tx.Lock()
+		for _, key := range keys {
+			tx.entities[key.Encode()] = nil
+		}
+		tx.Unlock()
+		return nil
+	}
+
+	m.Lock()
+	for _, key := range keys {
+		delete(m.entities, key.Encode())
+	}
+	m.Unlock()
+	return nil
+}
+
+func (m *mapDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	tx := &mapTransaction{entities: map[string]datastore.PropertyList{}}
+	if err := f(context.WithValue(c, mapTransactionKey{}, tx)); err != nil {
+		return err
+	}
+
+	m.Lock()
+	for key, pl := range tx.entities {
+		if pl == nil {
+			delete(m.entities, key)
+		} else {
+			m.entities[key] = pl
+		}
+	}
+	m.Unlock()
+	return nil
+}
+
+func TestSetDatastore(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	md := newMapDatastore()
+	nds.SetDatastore(md)
+	defer nds.SetDatastore(nds.AppEngineDatastore{})
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The App Engine datastore should never be used.
+	if err := datastore.Get(c, key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// Get from the datastore and populate the cache.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+	if md.getCount != 1 {
+		t.Fatal("expected 1 datastore get", md.getCount)
+	}
+
+	// Get from the cache.
+	te = &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+	if md.getCount != 1 {
+		t.Fatal("expected cache hit", md.getCount)
+	}
+
+	// A failed transaction should not change the entity.
+	expectedErr := errors.New("expected error")
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{64}); err != nil {
+			return err
+		}
+		return expectedErr
+	}, nil); err != expectedErr {
+		t.Fatal("expected error", err)
+	}
+
+	te = &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		return nds.Delete(tc, key)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
@@ -0,0 +1,266 @@
+package nds_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qedus/nds/v2"
+
+	"errors"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestDelete(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	keys := []*datastore.Key{key}
+	entities := make([]testEntity, 1)
+	entities[0].Val = 43
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	entities = make([]testEntity, 1)
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	entity := entities[0]
+	if entity.Val != 43 {
+		t.Fatal("incorrect entity.Val", entity.Val)
+	}
+
+	if err := nds.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	keys = []*datastore.Key{key}
+	entities = make([]testEntity, 1)
+	err = nds.GetMulti(c, keys, entities)
+	if me, ok := err.(appengine.MultiError); ok {
+		if me[0] != datastore.ErrNoSuchEntity {
+			t.Fatal("entity should be deleted", entities)
+		}
+	} else {
+		t.Fatal("expected appengine.MultiError")
+	}
+}
+
+func TestDeleteNilKey(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	if err := nds.Delete(c, nil); err != datastore.ErrInvalidKey {
+		t.Fatal("expected nil key error")
+	}
+}
+
+func TestDeleteIncompleteKey(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	if err := nds.Delete(c, nil); err != datastore.ErrInvalidKey {
+		t.Fatal("expected invalid key error")
+	}
+}
+
+func TestDeleteMemcacheFail(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	keys := []*datastore.Key{key}
+	entities := make([]testEntity, 1)
+	entities[0].Val = 43
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		return errors.New("expected error")
+	})
+
+	defer func() {
+		nds.SetMemcacheSetMulti(nds.ZeroMemcacheSetMulti)
+	}()
+
+	if err := nds.DeleteMulti(c, keys); err == nil {
+		t.Fatal("expected DeleteMulti error")
+	}
+}
+
+func TestDeleteInTransaction(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "TestEntity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		return nds.DeleteMulti(tc, []*datastore.Key{key})
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	err = nds.Get(c, key, &testEntity{})
+	if err == nil {
+		t.Fatal("expected no entity")
+	} else if err != datastore.ErrNoSuchEntity {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMultiLimit(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	for _, count := range []int{499, 500, 501, 1200} {
+
+		keys := []*datastore.Key{}
+		entities := []testEntity{}
+		for i := 0; i < count; i++ {
+			keys = append(keys,
+				datastore.NewKey(c, "Test", "", int64(i+1), nil))
+			entities = append(entities, testEntity{i})
+		}
+
+		if _, err := nds.PutMulti(c, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime cache.
+		if err := nds.GetMulti(c, keys, make([]testEntity, count)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := nds.DeleteMulti(c, keys); err != nil {
+			t.Fatal(err)
+		}
+
+		err := nds.GetMulti(c, keys, make([]testEntity, count))
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		for _, e := range me {
+			if e != datastore.ErrNoSuchEntity {
+				t.Fatal("expected datastore.ErrNoSuchEntity", e)
+			}
+		}
+	}
+}
+
+func TestDeleteMultiLimitMultiError(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	expectedErr := errors.New("expected error")
+
+	// Fail the delete of every key with an even IntID.
+	nds.SetDatastoreDeleteMulti(func(c context.Context,
+		keys []*datastore.Key) error {
+		me, isErr := make(appengine.MultiError, len(keys)), false
+		for i, key := range keys {
+			if key.IntID()%2 == 0 {
+				me[i] = expectedErr
+				isErr = true
+			}
+		}
+		if isErr {
+			return me
+		}
+		return datastore.DeleteMulti(c, keys)
+	})
+
+	defer func() {
+		nds.SetDatastoreDeleteMulti(datastore.DeleteMulti)
+	}()
+
+	count := 1001
+	keys := []*datastore.Key{}
+	for i := 0; i < count; i++ {
+		keys = append(keys, datastore.NewKey(c, "Test", "", int64(i+1), nil))
+	}
+
+	err = nds.DeleteMulti(c, keys)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if len(me) != count {
+		t.Fatal("incorrect length appengine.MultiError", len(me))
+	}
+	for i, e := range me {
+		if keys[i].IntID()%2 == 0 {
+			if e != expectedErr {
+				t.Fatalf("expected error at index %d", i)
+			}
+		} else if e != nil {
+			t.Fatalf("unexpected error at index %d: %s", i, e)
+		}
+	}
+}
+
+func TestDeleteMultiZeroKeys(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	if err := nds.DeleteMulti(c, []*datastore.Key{}); err != nil {
+		t.Fatal(err)
+	}
+}
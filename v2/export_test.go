@@ -0,0 +1,114 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var (
+	PropertyLoadSaverToPropertyList = propertyLoadSaverToPropertyList
+
+	ZeroMemcacheAddMulti            = zeroMemcacheAddMulti
+	ZeroMemcacheCompareAndSwapMulti = zeroMemcacheCompareAndSwapMulti
+	ZeroMemcacheDeleteMulti         = zeroMemcacheDeleteMulti
+	ZeroMemcacheGetMulti            = zeroMemcacheGetMulti
+	ZeroMemcacheSetMulti            = zeroMemcacheSetMulti
+
+	MarshalPropertyList   = marshalPropertyList
+	UnmarshalPropertyList = unmarshalPropertyList
+
+	NoneItem   = noneItem
+	EntityItem = entityItem
+	LockItem   = lockItem
+
+	CompressedEntityItem = compressedEntityItem
+	ManifestItem         = manifestItem
+
+	GlobalGenerationKey = defaultClient.globalGenerationKey()
+)
+
+func SetMemcacheAddMulti(f func(c context.Context,
+	items []*memcache.Item) error) {
+	memcacheAddMulti = f
+}
+
+func SetMemcacheCompareAndSwapMulti(f func(c context.Context,
+	items []*memcache.Item) error) {
+	memcacheCompareAndSwapMulti = f
+}
+
+func SetMemcacheDeleteMulti(f func(c context.Context, keys []string) error) {
+	memcacheDeleteMulti = f
+}
+
+func SetMemcacheGetMulti(f func(c context.Context,
+	keys []string) (map[string]*memcache.Item, error)) {
+	memcacheGetMulti = f
+}
+
+func SetMemcacheSetMulti(f func(c context.Context,
+	items []*memcache.Item) error) {
+	memcacheSetMulti = f
+}
+
+func SetDatastorePutMulti(f func(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error)) {
+	datastorePutMulti = f
+}
+
+func SetDatastoreDeleteMulti(f func(c context.Context,
+	keys []*datastore.Key) error) {
+	datastoreDeleteMulti = f
+}
+
+func SetDatastoreGetMulti(f func(c context.Context,
+	keys []*datastore.Key, vals interface{}) error) {
+	datastoreGetMulti = f
+}
+
+func SetMarshal(f func(pl datastore.PropertyList) ([]byte, error)) {
+	marshal = f
+}
+
+func SetUnmarshal(f func(data []byte, pl *datastore.PropertyList) error) {
+	unmarshal = f
+}
+
+func SetValue(val reflect.Value, pl datastore.PropertyList) error {
+	return setValue(val, pl)
+}
+
+func ChunkKeys(memcacheKey string, manifestValue []byte) ([]string, error) {
+	m, err := decodeManifest(manifestValue)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, m.chunkCount)
+	for i := range keys {
+		keys[i] = m.chunkKey(memcacheKey, i)
+	}
+	return keys, nil
+}
+
+// CreateMemcacheKey returns the memcache key key is currently cached under.
+func CreateMemcacheKey(c context.Context, key *datastore.Key) string {
+	gens, err := defaultClient.loadGenerations(c, []*datastore.Key{key})
+	if err != nil {
+		panic(err)
+	}
+	return defaultClient.createMemcacheKey(gens, key)
+}
+
+// CreateMemcacheKey returns the memcache key the client currently caches key
+// under.
+func (cl *Client) CreateMemcacheKey(c context.Context,
+	key *datastore.Key) string {
+	gens, err := cl.loadGenerations(c, []*datastore.Key{key})
+	if err != nil {
+		panic(err)
+	}
+	return cl.createMemcacheKey(gens, key)
+}
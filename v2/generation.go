@@ -0,0 +1,208 @@
+package nds
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// generations holds the generation values that are folded into memcache keys.
+// Changing a generation orphans every cache item created with the previous
+// value, which invalidates them without touching any other cache items.
+type generations struct {
+	global     uint64
+	namespaces map[string]uint64
+}
+
+// globalGenerationKey returns the cache key of the generation that applies to
+// all entities.
+func (cl *Client) globalGenerationKey() string {
+	return cl.prefix() + "generation"
+}
+
+func (cl *Client) namespaceGenerationKey(namespace string) string {
+	return cl.globalGenerationKey() + ":" + namespace
+}
+
+// newGeneration returns a new generation value. Values are based on the time
+// rather than incremented so that a generation evicted from the cache is never
+// recreated with a value that stale cache items might still be using.
+func newGeneration() []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	return b
+}
+
+// generationContext returns the context generations are cached with. They are
+// always kept in the default namespace so that they are shared by all
+// contexts.
+func generationContext(c context.Context) (context.Context, error) {
+	return appengine.Namespace(c, "")
+}
+
+// loadGenerations gets the global generation and the generations of the
+// namespaces of keys. Generations that are not yet cached are created.
+//
+// Generations are never kept between calls, even within a request, as a get
+// that used an old generation after InvalidateAll could return an invalidated
+// entity. Each call therefore costs a cache GetMulti. Gets call it once and
+// writers twice, the second time through changedMemcacheKeys.
+func (cl *Client) loadGenerations(c context.Context,
+	keys []*datastore.Key) (generations, error) {
+
+	gc, err := generationContext(c)
+	if err != nil {
+		return generations{}, err
+	}
+
+	generationKeys := []string{cl.globalGenerationKey()}
+	namespaces := map[string]string{}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		namespace := key.Namespace()
+		if _, ok := namespaces[namespace]; !ok {
+			namespaces[namespace] = cl.namespaceGenerationKey(namespace)
+			generationKeys = append(generationKeys, namespaces[namespace])
+		}
+	}
+
+	items, err := cache.GetMulti(gc, generationKeys)
+	if err != nil {
+		return generations{}, err
+	}
+
+	addItems := []*Item{}
+	for _, key := range generationKeys {
+		if _, ok := items[key]; !ok {
+			addItems = append(addItems, &Item{
+				Key:   key,
+				Flags: generationItem,
+				Value: newGeneration(),
+			})
+		}
+	}
+
+	// Another request may add the same generations concurrently so they are
+	// got again to make sure everyone uses the same values.
+	if len(addItems) > 0 {
+		if err := cache.AddMulti(gc, addItems); err != nil {
+			if _, ok := err.(appengine.MultiError); !ok {
+				return generations{}, err
+			}
+		}
+
+		addKeys := make([]string, len(addItems))
+		for i, item := range addItems {
+			addKeys[i] = item.Key
+		}
+		addedItems, err := cache.GetMulti(gc, addKeys)
+		if err != nil {
+			return generations{}, err
+		}
+		for key, item := range addedItems {
+			items[key] = item
+		}
+	}
+
+	value := func(key string) (uint64, error) {
+		item, ok := items[key]
+		if !ok || item.Flags != generationItem || len(item.Value) != 8 {
+			return 0, errors.New("nds: generation unavailable")
+		}
+		return binary.LittleEndian.Uint64(item.Value), nil
+	}
+
+	gens := generations{namespaces: make(map[string]uint64, len(namespaces))}
+	if gens.global, err = value(cl.globalGenerationKey()); err != nil {
+		return generations{}, err
+	}
+	for namespace, key := range namespaces {
+		if gens.namespaces[namespace], err = value(key); err != nil {
+			return generations{}, err
+		}
+	}
+	return gens, nil
+}
+
+// changedMemcacheKeys returns the memcache keys that keys map to now if they
+// differ from memcacheKeys, the memcache keys they mapped to when they were
+// locked. Writers use it after changing the datastore to remove any entity a
+// reader has cached under a generation created while the write was in
+// progress.
+func (cl *Client) changedMemcacheKeys(c context.Context,
+	keys []*datastore.Key, memcacheKeys []string) []string {
+
+	gens, err := cl.loadGenerations(c, keys)
+	if err != nil {
+		logger.Warningf(c, "nds:changedMemcacheKeys loadGenerations %s", err)
+		return nil
+	}
+
+	changedKeys := []string{}
+	for i, key := range keys {
+		if memcacheKey := cl.createMemcacheKey(gens, key); memcacheKey !=
+			memcacheKeys[i] {
+			changedKeys = append(changedKeys, memcacheKey)
+		}
+	}
+	return changedKeys
+}
+
+// InvalidateAll invalidates every entity cached by nds. It does this by
+// changing the global generation that is part of every cache key so other
+// cache items are not affected. Orphaned cache items are left to be evicted.
+// The local cache of c, if it has one, is cleared.
+func InvalidateAll(c context.Context) error {
+	return defaultClient.InvalidateAll(c)
+}
+
+// InvalidateAll works like the package level InvalidateAll using the Client's
+// Options.
+func (cl *Client) InvalidateAll(c context.Context) error {
+	return setGeneration(c, cl.globalGenerationKey())
+}
+
+// InvalidateNamespace invalidates every entity in namespace that is cached by
+// nds. The local cache of c, if it has one, is cleared.
+func InvalidateNamespace(c context.Context, namespace string) error {
+	return defaultClient.InvalidateNamespace(c, namespace)
+}
+
+// InvalidateNamespace works like the package level InvalidateNamespace using
+// the Client's Options.
+func (cl *Client) InvalidateNamespace(c context.Context,
+	namespace string) error {
+	return setGeneration(c, cl.namespaceGenerationKey(namespace))
+}
+
+func setGeneration(c context.Context, key string) error {
+	if lc, ok := localCacheContext(c); ok {
+		lc.evictAll()
+	}
+
+	gc, err := generationContext(c)
+	if err != nil {
+		return err
+	}
+
+	return cache.SetMulti(gc, []*Item{{
+		Key:   key,
+		Flags: generationItem,
+		Value: newGeneration(),
+	}})
+}
+
+func (cl *Client) createMemcacheKey(gens generations,
+	key *datastore.Key) string {
+	return cl.prefix() +
+		strconv.FormatUint(gens.global, 16) + ":" +
+		strconv.FormatUint(gens.namespaces[key.Namespace()], 16) + ":" +
+		key.Encode()
+}
@@ -0,0 +1,188 @@
+package nds_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestInvalidateAll(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	// The local cache is cleared too.
+	lc := nds.NewContext(c)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the entity behind nds' back.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldMemcacheKey := nds.CreateMemcacheKey(c, key)
+	if err := nds.InvalidateAll(lc); err != nil {
+		t.Fatal(err)
+	}
+	if nds.CreateMemcacheKey(c, key) == oldMemcacheKey {
+		t.Fatal("expected memcache key to change")
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 2 {
+		t.Fatal("expected new entity", te.IntVal)
+	}
+
+	// Other cache items are left alone.
+	if _, err := memcache.Get(c, oldMemcacheKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidateNamespace(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	contexts := []context.Context{}
+	keys := []*datastore.Key{}
+	for _, namespace := range []string{"one", "two"} {
+		nc, err := appengine.Namespace(c, namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := datastore.NewKey(nc, "Entity", "", 1, nil)
+		if _, err := nds.Put(nc, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nds.Get(nc, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := datastore.Put(nc, key, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		contexts = append(contexts, nc)
+		keys = append(keys, key)
+	}
+
+	if err := nds.InvalidateNamespace(c, "one"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{2, 1}
+	for i, key := range keys {
+		te := &testEntity{}
+		if err := nds.Get(contexts[i], key, te); err != nil {
+			t.Fatal(err)
+		}
+		if te.IntVal != expected[i] {
+			t.Fatal("expected", expected[i], "got", te.IntVal)
+		}
+	}
+}
+
+func TestGenerationEvicted(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entities cached with an evicted generation must not be used again.
+	if err := memcache.Delete(c, nds.GlobalGenerationKey); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 2 {
+		t.Fatal("expected new entity", te.IntVal)
+	}
+}
+
+func TestInvalidateAllDuringPut(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalidate and cache the old entity under the new generation while the
+	// entity is being put.
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		if err := nds.InvalidateAll(c); err != nil {
+			return nil, err
+		}
+		if err := nds.Get(c, key, &testEntity{}); err != nil {
+			return nil, err
+		}
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 2 {
+		t.Fatal("expected new entity", te.IntVal)
+	}
+}
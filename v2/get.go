@@ -0,0 +1,625 @@
+package nds
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// getMultiLimit is the App Engine datastore limit for the maximum number
+// of entities that can be got by datastore.GetMulti at once.
+// nds.GetMulti increases this limit by performing as many
+// datastore.GetMulti as required concurrently and collating the results.
+const getMultiLimit = 1000
+
+// lockWaitDelay is how long a get first waits before polling the cache again
+// for an entity locked by another request. The delay doubles after each poll.
+const lockWaitDelay = 10 * time.Millisecond
+
+// SetLockWait sets how long the package level functions wait for entities
+// that other requests have locked, as described by Options.LockWait. Clients
+// use the LockWait of their own Options. d must not be negative. The default
+// of zero reads the datastore straight away.
+//
+// It is not safe to call SetLockWait concurrently with other nds functions so
+// it should be called once during app initialisation.
+func SetLockWait(d time.Duration) {
+	defaultClient.opts.LockWait = d
+}
+
+// GetMulti works similar to datastore.GetMulti except for two important
+// advantages:
+//
+// 1) It removes the API limit of 1000 entities per request by
+// calling the datastore as many times as required to fetch all the keys. It
+// does this efficiently and concurrently.
+//
+// 2) GetMulti function will automatically use memcache where possible before
+// accssing the datastore. It uses a caching mechanism similar to the Python
+// ndb package. However consistency is improved as NDB consistency issue
+// http://goo.gl/3ByVlA is not an issue here or accessing the same key
+// concurrently.
+//
+// If memcache is not working for any reason, GetMulti will default to using
+// the datastore without compromising cache consistency.
+//
+// Important: If you use nds.GetMulti, you must also use the NDS put and delete
+// functions in all your code touching the datastore to ensure data consistency.
+// This includes using nds.RunInTransaction instead of
+// datastore.RunInTransaction.
+//
+// Increase the datastore timeout if you get datastore_v3: TIMEOUT errors when
+// getting thousands of entities. You can do this using
+// http://godoc.org/code.google.com/p/appengine-go/appengine#Timeout.
+//
+// vals must be a []S, []*S, []I or []P, for some struct type S, some interface
+// type I, or some non-interface non-pointer type P such that P or *P implements
+// datastore.PropertyLoadSaver. If an []I, each element must be a valid dst for
+// Get: it must be a struct pointer or implement datastore.PropertyLoadSaver.
+// This includes []datastore.PropertyList and []*datastore.PropertyList.
+//
+// As a special case, datastore.PropertyList is an invalid type for dst, even
+// though a PropertyList is a slice of structs. It is treated as invalid to
+// avoid being mistakenly passed when []datastore.PropertyList was intended.
+func GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+	return defaultClient.GetMulti(c, keys, vals)
+}
+
+// GetMulti works like the package level GetMulti using the Client's Options.
+func (cl *Client) GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	v := reflect.ValueOf(vals)
+	if err := checkMultiArgs(keys, v); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	limit := cl.getMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
+	errs := make([]error, callCount)
+
+	wg := sync.WaitGroup{}
+	wg.Add(callCount)
+	for i := 0; i < callCount; i++ {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		index := i
+		keySlice := keys[lo:hi]
+		valSlice := v.Slice(lo, hi)
+
+		go func() {
+			if txc, ok := transactionContext(c); ok {
+				errs[index] = txc.getMulti(c, keySlice, valSlice)
+			} else {
+				errs[index] = cl.getMulti(c, keySlice, valSlice)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	// Quick escape if all errors are nil.
+	errsNil := true
+	for _, err := range errs {
+		if err != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+
+	groupedErrs := make(appengine.MultiError, len(keys))
+	for i, err := range errs {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		if me, ok := err.(appengine.MultiError); ok {
+			copy(groupedErrs[lo:hi], me)
+		} else if err != nil {
+			return err
+		}
+	}
+	return groupedErrs
+}
+
+// Get loads the entity stored for key into val, which must be a struct pointer.
+// Currently PropertyLoadSaver is not implemented. If there is no such entity
+// for the key, Get returns ErrNoSuchEntity.
+//
+// The values of val's unmatched struct fields are not modified, and matching
+// slice-typed fields are not reset before appending to them. In particular, it
+// is recommended to pass a pointer to a zero valued struct on each Get call.
+//
+// ErrFieldMismatch is returned when a field is to be loaded into a different
+// type than the one it was stored from, or when a field is missing or
+// unexported in the destination struct. ErrFieldMismatch is only returned if
+// val is a struct pointer.
+func Get(c context.Context, key *datastore.Key, val interface{}) error {
+	return defaultClient.Get(c, key, val)
+}
+
+// Get works like the package level Get using the Client's Options.
+func (cl *Client) Get(c context.Context,
+	key *datastore.Key, val interface{}) error {
+
+	err := cl.GetMulti(c, []*datastore.Key{key}, []interface{}{val})
+	if me, ok := err.(appengine.MultiError); ok {
+		return me[0]
+	}
+	return err
+}
+
+type cacheState byte
+
+const (
+	miss cacheState = iota
+	internalLock
+	externalLock
+	done
+)
+
+type cacheItem struct {
+	key           *datastore.Key
+	memcacheKey   string
+	localCacheKey string
+
+	val reflect.Value
+	err error
+
+	// pl is the loaded entity so that it can be saved to the local cache.
+	pl datastore.PropertyList
+
+	policy Policy
+
+	stats Stats
+
+	item *Item
+
+	state cacheState
+
+	// otherLock is true when the entity is an externalLock because another
+	// request has locked it to cache the entity. Only these entities are
+	// waited for. The locks left on missing entities by Policy.NoCacheMissing
+	// are not as they are never replaced by the entity.
+	otherLock bool
+}
+
+// getMulti attempts to get entities from, memcache, then the datastore.
+// datastore. It also tries to replenish memcache if needed available. It does
+// this in such a way that GetMulti will never get stale results even if the
+// function, datastore or server fails at any point. The caching strategy is
+// borrowed from Python ndb with some improvements that eliminate some
+// consistency issues surrounding ndb, including http://goo.gl/3ByVlA.
+func (cl *Client) getMulti(c context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	lc, isLocal := localCacheContext(c)
+
+	cacheItems := make([]cacheItem, len(keys))
+	for i, key := range keys {
+		cacheItems[i].key = key
+		cacheItems[i].val = vals.Index(i)
+		cacheItems[i].policy = cl.kindPolicy(key.Kind())
+
+		if isLocal {
+			cacheItems[i].localCacheKey = cl.localCacheKey(key)
+		}
+
+		// Entities that shouldn't be cached, or that earlier versions sharing
+		// the cache may change without locking, are read straight from the
+		// datastore.
+		if cacheItems[i].policy.NoCache || legacyCache {
+			cacheItems[i].state = externalLock
+		} else {
+			cacheItems[i].state = miss
+		}
+	}
+
+	// The local cache is checked first as it does not need the generations.
+	var version uint64
+	if isLocal {
+		version = lc.load(c, cacheItems)
+	}
+
+	cl.createMemcacheKeys(c, cacheItems)
+
+	cl.loadMemcache(c, cacheItems)
+
+	cl.lockMemcache(c, cacheItems)
+
+	cl.waitForLocks(c, cacheItems)
+
+	if err := cl.loadDatastore(c, cacheItems, vals.Type()); err != nil {
+		return err
+	}
+
+	saveMemcache(c, cacheItems)
+
+	if isLocal {
+		lc.save(version, cacheItems)
+	}
+
+	addStats(cacheItems)
+
+	me, errsNil := make(appengine.MultiError, len(cacheItems)), true
+	for i, cacheItem := range cacheItems {
+		if cacheItem.err != nil {
+			me[i] = cacheItem.err
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// createMemcacheKeys sets the memcache keys of the cacheItems that are still
+// misses. Without the generations there are no memcache keys so memcache is
+// not used at all.
+func (cl *Client) createMemcacheKeys(c context.Context,
+	cacheItems []cacheItem) {
+
+	keys := make([]*datastore.Key, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			keys = append(keys, cacheItem.key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	gens, err := cl.loadGenerations(c, keys)
+	if err != nil {
+		logger.Warningf(c, "nds:createMemcacheKeys loadGenerations %s", err)
+	}
+
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		if err == nil {
+			cacheItems[i].memcacheKey = cl.createMemcacheKey(gens, cacheItem.key)
+		} else {
+			cacheItems[i].state = externalLock
+		}
+	}
+}
+
+func (cl *Client) loadMemcache(c context.Context, cacheItems []cacheItem) {
+
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	cacheItemsIndex := make([]int, 0, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+			cacheItemsIndex = append(cacheItemsIndex, i)
+		}
+	}
+
+	items, err := cache.GetMulti(c, memcacheKeys)
+	if err != nil {
+		for _, i := range cacheItemsIndex {
+			cacheItems[i].state = externalLock
+		}
+		logger.Warningf(c, "nds:loadMemcache GetMulti %s", err)
+		return
+	}
+
+	manifestIndex := []int{}
+	for j, memcacheKey := range memcacheKeys {
+		i := cacheItemsIndex[j]
+		if item, ok := items[memcacheKey]; ok {
+			switch item.Flags {
+			case lockItem:
+				cacheItems[i].state = externalLock
+				cacheItems[i].otherLock = !bytes.Equal(item.Value, missingLock)
+			case noneItem:
+				cacheItems[i].state = done
+				cacheItems[i].err = datastore.ErrNoSuchEntity
+				cacheItems[i].stats.Hits++
+			case entityItem, compressedEntityItem:
+				cacheItems[i].item = item
+				cl.loadEntityItem(c, &cacheItems[i], item, "nds:loadMemcache")
+			case manifestItem:
+				cacheItems[i].item = item
+				manifestIndex = append(manifestIndex, i)
+			default:
+				logger.Warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
+				cacheItems[i].state = externalLock
+			}
+		} else {
+			cacheItems[i].stats.Misses++
+		}
+	}
+
+	if len(manifestIndex) > 0 {
+		cl.loadChunks(c, cacheItems, manifestIndex)
+	}
+}
+
+// loadEntityItem loads the entity cached in item into cacheItem. prefix is
+// used when logging warnings. If item cannot be decoded, for example because
+// it was cached with another codec version, the cacheItem is left as a miss so
+// that lockMemcache can replace the cached item, which the caller must have
+// stored in cacheItem.item, with a lock and the entity is cached again.
+func (cl *Client) loadEntityItem(c context.Context,
+	cacheItem *cacheItem, item *Item, prefix string) {
+
+	pl := datastore.PropertyList{}
+	if err := cl.unmarshalEntity(item, &pl); err != nil {
+		logger.Warningf(c, "%s unmarshal %s", prefix, err)
+		cacheItem.state = miss
+		cacheItem.stats.UnmarshalErrors++
+		return
+	}
+	if err := setValue(cacheItem.val, pl); err == nil {
+		cacheItem.state = done
+		cacheItem.pl = pl
+		cacheItem.stats.Hits++
+	} else {
+		logger.Warningf(c, "%s setValue %s", prefix, err)
+		cacheItem.state = externalLock
+		cacheItem.stats.SetValueErrors++
+	}
+}
+
+func (cl *Client) lockMemcache(c context.Context, cacheItems []cacheItem) {
+
+	lockItems := make([]*Item, 0, len(cacheItems))
+	casLockItems := []*Item{}
+	lockMemcacheKeys := make([]string, 0, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+
+			item := &Item{
+				Key:        cacheItem.memcacheKey,
+				Flags:      lockItem,
+				Value:      itemLock(),
+				Expiration: cl.lockTime(),
+			}
+
+			// Manifests with evicted chunks and entities that cannot be
+			// decoded are replaced with the lock only if they haven't
+			// changed since they were got.
+			if cacheItem.item != nil {
+				item.SetCASInfo(cacheItem.item.GetCASInfo())
+				casLockItems = append(casLockItems, item)
+			} else {
+				lockItems = append(lockItems, item)
+			}
+			cacheItems[i].item = item
+			lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
+		}
+	}
+
+	// We don't care if there are errors here.
+	if err := cache.AddMulti(c, lockItems); err != nil {
+		logger.Warningf(c, "nds:lockMemcache AddMulti %s", err)
+	}
+	if err := cache.CompareAndSwapMulti(c, casLockItems); err != nil {
+		logger.Warningf(c, "nds:lockMemcache CompareAndSwapMulti %s", err)
+	}
+
+	// Get the items again so we can use CAS when updating the cache.
+	items, err := cache.GetMulti(c, lockMemcacheKeys)
+
+	// Cache failed so forget about it and just use the datastore.
+	if err != nil {
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == miss {
+				cacheItems[i].state = externalLock
+			}
+		}
+		logger.Warningf(c, "nds:lockMemcache GetMulti %s", err)
+		return
+	}
+
+	// Cache worked so figure out what items we got.
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			if item, ok := items[cacheItem.memcacheKey]; ok {
+				switch item.Flags {
+				case lockItem:
+					if bytes.Equal(item.Value, cacheItem.item.Value) {
+						cacheItems[i].item = item
+						cacheItems[i].state = internalLock
+					} else {
+						cacheItems[i].state = externalLock
+						cacheItems[i].otherLock = !bytes.Equal(item.Value,
+							missingLock)
+					}
+				case noneItem:
+					cacheItems[i].state = done
+					cacheItems[i].err = datastore.ErrNoSuchEntity
+					cacheItems[i].stats.Hits++
+				case entityItem, compressedEntityItem:
+					cl.loadEntityItem(c, &cacheItems[i], item,
+						"nds:lockMemcache")
+					if cacheItems[i].state == miss {
+						// Another request has just cached an entity that
+						// cannot be decoded.
+						cacheItems[i].state = externalLock
+					}
+				case manifestItem:
+					// Another request has just cached a large entity.
+					cacheItems[i].state = externalLock
+					cacheItems[i].otherLock = true
+				default:
+					logger.Warningf(c, "nds:lockMemcache unknown item.Flags %d",
+						item.Flags)
+					cacheItems[i].state = externalLock
+				}
+			} else {
+				// We just added a memcache item but it now isn't available so
+				// treat it as an extarnal lock.
+				cacheItems[i].state = externalLock
+			}
+		}
+	}
+}
+
+// waitForLocks polls the cache, backing off exponentially, for entities that
+// other requests have locked until they are cached or the client's LockWait
+// has passed. This stops every request that gets a hot entity while it is
+// being updated from reading it from the datastore. Entities the lock is
+// removed from without being cached are locked by this request instead.
+func (cl *Client) waitForLocks(c context.Context, cacheItems []cacheItem) {
+	if cl.opts.LockWait <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(cl.opts.LockWait)
+	delay := lockWaitDelay
+	for {
+		waiting := false
+		for _, cacheItem := range cacheItems {
+			if cacheItem.state == externalLock && cacheItem.otherLock {
+				waiting = true
+				break
+			}
+		}
+		remaining := deadline.Sub(time.Now())
+		if !waiting || remaining <= 0 {
+			return
+		}
+
+		if delay > remaining {
+			delay = remaining
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.Done():
+			return
+		}
+		delay *= 2
+
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == externalLock && cacheItem.otherLock {
+				cacheItems[i].state = miss
+				cacheItems[i].otherLock = false
+				cacheItems[i].item = nil
+				cacheItems[i].stats.LockWaits++
+			}
+		}
+		cl.loadMemcache(c, cacheItems)
+		cl.lockMemcache(c, cacheItems)
+	}
+}
+
+func (cl *Client) loadDatastore(c context.Context, cacheItems []cacheItem,
+	valsType reflect.Type) error {
+
+	keys := make([]*datastore.Key, 0, len(cacheItems))
+	vals := make([]datastore.PropertyList, 0, len(cacheItems))
+	cacheItemsIndex := make([]int, 0, len(cacheItems))
+
+	for i, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case internalLock:
+			cacheItems[i].stats.InternalLocks++
+		case externalLock:
+			if !cacheItem.policy.NoCache && !legacyCache {
+				cacheItems[i].stats.ExternalLocks++
+			}
+		default:
+			continue
+		}
+		keys = append(keys, cacheItem.key)
+		vals = append(vals, datastore.PropertyList{})
+		cacheItemsIndex = append(cacheItemsIndex, i)
+		cacheItems[i].stats.DatastoreGets++
+	}
+
+	var me appengine.MultiError
+	if err := datastoreBackend.GetMulti(c, keys, vals); err == nil {
+		me = make(appengine.MultiError, len(keys))
+	} else if e, ok := err.(appengine.MultiError); ok {
+		me = e
+	} else {
+		return err
+	}
+
+	for i, index := range cacheItemsIndex {
+		switch me[i] {
+		case nil:
+			pl := vals[i]
+			val := cacheItems[index].val
+			if err := setValue(val, pl); err != nil {
+				return err
+			}
+			cacheItems[index].pl = pl
+
+			if cacheItems[index].state == internalLock {
+				cacheItems[index].item.Expiration =
+					cacheItems[index].policy.Expiration
+				if data, flags, err := cl.marshalEntity(pl); err == nil {
+					cacheItems[index].item.Flags = flags
+					cacheItems[index].item.Value = data
+				} else {
+					cacheItems[index].state = externalLock
+					logger.Warningf(c, "nds:loadDatastore marshal %s", err)
+				}
+			}
+		case datastore.ErrNoSuchEntity:
+			if cacheItems[index].state == internalLock {
+				policy := cacheItems[index].policy
+				if policy.NoCacheMissing {
+					// Shorten the lock rather than caching the missing
+					// entity.
+					cacheItems[index].item.Expiration = missingLockTime
+					cacheItems[index].item.Value = missingLock
+				} else {
+					cacheItems[index].item.Flags = noneItem
+					cacheItems[index].item.Expiration =
+						policy.missingExpiration()
+					cacheItems[index].item.Value = []byte{}
+				}
+			}
+			cacheItems[index].err = datastore.ErrNoSuchEntity
+		default:
+			cacheItems[index].state = externalLock
+			cacheItems[index].err = me[i]
+		}
+	}
+	return nil
+}
+
+func saveMemcache(c context.Context, cacheItems []cacheItem) {
+
+	saveItems := make([]*Item, 0, len(cacheItems))
+	chunkItems := []*Item{}
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock {
+			if len(cacheItem.item.Value) > memcacheMaxItemSize {
+				chunkItems = append(chunkItems, splitItem(cacheItem.item)...)
+			}
+			saveItems = append(saveItems, cacheItem.item)
+		}
+	}
+
+	saveItems = saveChunks(c, "nds:saveMemcache", saveItems, chunkItems)
+
+	if err := cache.CompareAndSwapMulti(c, saveItems); err != nil {
+		logger.Warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+	}
+}
@@ -0,0 +1,90 @@
+package nds
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Invalidate removes the entities for keys from the cache so that they are
+// next got from the datastore. It should be called after entities have been
+// changed without using nds, for example by
+// google.golang.org/appengine/datastore or a datastore admin job. Any get that
+// is already refreshing the cache for one of the keys will fail to save its
+// possibly stale entity as the cache item it locked no longer exists.
+func Invalidate(c context.Context, keys []*datastore.Key) error {
+	return defaultClient.Invalidate(c, keys)
+}
+
+// Invalidate works like the package level Invalidate using the Client's
+// Options.
+func (cl *Client) Invalidate(c context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+	}
+
+	gens, err := cl.loadGenerations(c, keys)
+	if err != nil {
+		return err
+	}
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = cl.createMemcacheKey(gens, key)
+	}
+
+	if lc, ok := localCacheContext(c); ok {
+		lc.evict(cl.localCacheKeys(keys))
+	}
+
+	// Keys that are not cached have nothing to invalidate.
+	err = cache.DeleteMulti(c,
+		append(memcacheKeys, legacyMemcacheKeys(keys)...))
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for _, err := range me {
+		if err != nil && err != memcache.ErrCacheMiss {
+			return me
+		}
+	}
+	return nil
+}
+
+// Warm loads the entities for keys into the cache if they are not already
+// cached. Keys without an entity are cached as missing unless their kind's
+// Policy sets NoCacheMissing. Warm uses the same locking as GetMulti so it is
+// safe to call at any time, for example after Invalidate or when an instance
+// starts.
+func Warm(c context.Context, keys []*datastore.Key) error {
+	return defaultClient.Warm(c, keys)
+}
+
+// Warm works like the package level Warm using the Client's Options.
+func (cl *Client) Warm(c context.Context, keys []*datastore.Key) error {
+	if _, ok := transactionContext(c); ok {
+		return errors.New("nds: Warm cannot be used in a transaction")
+	}
+
+	// Skip the local cache so that the entities always reach memcache.
+	c = withoutLocalCache(c)
+
+	vals := make([]datastore.PropertyList, len(keys))
+	err := cl.GetMulti(c, keys, vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for _, err := range me {
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return me
+		}
+	}
+	return nil
+}
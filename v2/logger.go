@@ -0,0 +1,40 @@
+package nds
+
+import (
+	"context"
+	"log"
+
+	"google.golang.org/appengine"
+	aelog "google.golang.org/appengine/log"
+)
+
+// Logger is the interface nds uses to report errors it recovers from, such as
+// an unavailable cache. The default is AppEngineLogger.
+type Logger interface {
+	Warningf(c context.Context, format string, args ...interface{})
+}
+
+var logger Logger = AppEngineLogger{}
+
+// SetLogger sets the Logger used by nds. It is not safe to call SetLogger
+// concurrently with other nds functions so it should be called once during
+// app initialisation.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// AppEngineLogger is the default Logger. It writes to the App Engine log when
+// the app is running on App Engine and to the standard library log otherwise,
+// for example in tests.
+type AppEngineLogger struct{}
+
+// Warningf logs a warning.
+func (AppEngineLogger) Warningf(c context.Context,
+	format string, args ...interface{}) {
+
+	if appengine.IsAppEngine() {
+		aelog.Warningf(c, format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,98 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+// getErrorCache is a mapCache whose GetMulti always fails.
+type getErrorCache struct {
+	*mapCache
+}
+
+func (getErrorCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	return nil, errors.New("expected error")
+}
+
+// recordLogger records the warnings it is given.
+type recordLogger struct {
+	sync.Mutex
+	warnings []string
+}
+
+func (l *recordLogger) Warningf(c context.Context,
+	format string, args ...interface{}) {
+
+	l.Lock()
+	defer l.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+// getWithBackground gets an entity with a context that is not an App Engine
+// context, which makes nds log a warning as the cache is unavailable. The key
+// is made with an App Engine context as datastore.NewKey needs one.
+func getWithBackground(t *testing.T) {
+	ac, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+	key := datastore.NewKey(ac, "Entity", "", 1, nil)
+
+	c := context.Background()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetDatastore(newMapDatastore())
+	defer nds.SetDatastore(nds.AppEngineDatastore{})
+	mc := newMapCache()
+	nds.SetCache(mc)
+	defer nds.SetCache(nds.Memcache{})
+
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetCache(getErrorCache{mc})
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 43 {
+		t.Fatal("incorrect entity.IntVal", entity.IntVal)
+	}
+}
+
+func TestAppEngineLoggerBackgroundContext(t *testing.T) {
+	getWithBackground(t)
+}
+
+func TestSetLogger(t *testing.T) {
+	l := &recordLogger{}
+	nds.SetLogger(l)
+	defer nds.SetLogger(nds.AppEngineLogger{})
+
+	getWithBackground(t)
+
+	l.Lock()
+	defer l.Unlock()
+	for _, w := range l.warnings {
+		if strings.Contains(w, "expected error") {
+			return
+		}
+	}
+	t.Fatal("expected warning", l.warnings)
+}
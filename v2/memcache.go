@@ -0,0 +1,72 @@
+package nds
+
+import (
+	"context"
+
+	"google.golang.org/appengine/memcache"
+)
+
+// Memcache is the default Cache. It uses the App Engine memcache service.
+type Memcache struct{}
+
+// AddMulti is a batch version of memcache.Add.
+func (Memcache) AddMulti(c context.Context, items []*Item) error {
+	return memcacheAddMulti(c, toMemcacheItems(items))
+}
+
+// CompareAndSwapMulti is a batch version of memcache.CompareAndSwap. The items
+// must have been got with Memcache.GetMulti.
+func (Memcache) CompareAndSwapMulti(c context.Context, items []*Item) error {
+	return memcacheCompareAndSwapMulti(c, toMemcacheItems(items))
+}
+
+// DeleteMulti is a batch version of memcache.Delete.
+func (Memcache) DeleteMulti(c context.Context, keys []string) error {
+	return memcacheDeleteMulti(c, keys)
+}
+
+// GetMulti is a batch version of memcache.Get.
+func (Memcache) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	memcacheItems, err := memcacheGetMulti(c, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*Item, len(memcacheItems))
+	for key, memcacheItem := range memcacheItems {
+		item := &Item{
+			Key:        memcacheItem.Key,
+			Value:      memcacheItem.Value,
+			Flags:      memcacheItem.Flags,
+			Expiration: memcacheItem.Expiration,
+		}
+		item.SetCASInfo(memcacheItem)
+		items[key] = item
+	}
+	return items, nil
+}
+
+// SetMulti is a batch version of memcache.Set.
+func (Memcache) SetMulti(c context.Context, items []*Item) error {
+	return memcacheSetMulti(c, toMemcacheItems(items))
+}
+
+// toMemcacheItems converts items to memcache items. Items that were got from
+// memcache reuse their original memcache item so that its CAS ID is retained.
+func toMemcacheItems(items []*Item) []*memcache.Item {
+	memcacheItems := make([]*memcache.Item, len(items))
+	for i, item := range items {
+		memcacheItem, ok := item.GetCASInfo().(*memcache.Item)
+		if !ok {
+			memcacheItem = &memcache.Item{}
+		}
+		memcacheItem.Key = item.Key
+		memcacheItem.Value = item.Value
+		memcacheItem.Flags = item.Flags
+		memcacheItem.Expiration = item.Expiration
+		memcacheItems[i] = memcacheItem
+	}
+	return memcacheItems
+}
@@ -0,0 +1,300 @@
+package nds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	// memcachedKeyLimit is the maximum length of a memcached key.
+	memcachedKeyLimit = 250
+
+	// memcachedRelativeExpirationLimit is the longest expiration memcached
+	// treats as relative. Longer expirations must be sent as Unix times.
+	memcachedRelativeExpirationLimit = 30 * 24 * time.Hour
+)
+
+var (
+	memcachedStored    = []byte("STORED\r\n")
+	memcachedNotStored = []byte("NOT_STORED\r\n")
+	memcachedExists    = []byte("EXISTS\r\n")
+	memcachedNotFound  = []byte("NOT_FOUND\r\n")
+	memcachedDeleted   = []byte("DELETED\r\n")
+	memcachedEnd       = []byte("END\r\n")
+)
+
+// Memcached is a Cache that uses a memcached server over the memcached text
+// protocol in place of App Engine memcache. Use NewMemcached to create one.
+//
+// Per item failures are returned as an appengine.MultiError containing
+// memcache.ErrNotStored, memcache.ErrCASConflict or memcache.ErrCacheMiss, the
+// same errors as the Memcache Cache.
+type Memcached struct {
+	pool *connPool
+}
+
+// NewMemcached returns a Memcached that connects to the memcached server at
+// addr, for example "localhost:11211". Each call to the server, including
+// dialing, is allowed timeout or the time left before the context's deadline,
+// whichever is shorter. A zero timeout selects a default of five seconds.
+func NewMemcached(addr string, timeout time.Duration) *Memcached {
+	return &Memcached{pool: newConnPool(addr, timeout)}
+}
+
+// memcachedKey returns the key used for key on the server. Keys that memcached
+// cannot store, because they are too long or contain spaces or control
+// characters, are hashed.
+func memcachedKey(key string) string {
+	valid := len(key) <= memcachedKeyLimit
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+	hash := sha1.Sum([]byte(key))
+	return "nds:sha1:" + hex.EncodeToString(hash[:])
+}
+
+// memcachedExpiration converts d to the expiration time memcached expects.
+func memcachedExpiration(d time.Duration) int64 {
+	switch {
+	case d <= 0:
+		return 0
+	case d > memcachedRelativeExpirationLimit:
+		return time.Now().Add(d).Unix()
+	case d < time.Second:
+		return 1
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// readLine reads a response line, including its trailing "\r\n".
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("nds: malformed memcached response")
+	}
+	return line, nil
+}
+
+// memcachedError returns the error for a response line that is not one of the
+// expected replies.
+func memcachedError(line []byte) error {
+	return fmt.Errorf("nds: memcached error %q",
+		string(bytes.TrimSuffix(line, []byte("\r\n"))))
+}
+
+// store runs the storage command verb for each item.
+func (m *Memcached) store(c context.Context, verb string,
+	items []*Item) error {
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	casIDs := make([]uint64, len(items))
+	if verb == "cas" {
+		for i, item := range items {
+			casID, ok := item.GetCASInfo().(uint64)
+			if !ok {
+				return errors.New("nds: item was not got with Memcached")
+			}
+			casIDs[i] = casID
+		}
+	}
+
+	errs := make(appengine.MultiError, len(items))
+	errsNil := true
+	err := m.pool.do(c, func(w *bufio.Writer) error {
+		for i, item := range items {
+			fmt.Fprintf(w, "%s %s %d %d %d", verb, memcachedKey(item.Key),
+				item.Flags, memcachedExpiration(item.Expiration),
+				len(item.Value))
+			if verb == "cas" {
+				fmt.Fprintf(w, " %d", casIDs[i])
+			}
+			w.WriteString("\r\n")
+			w.Write(item.Value)
+			if _, err := w.WriteString("\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(r *bufio.Reader) error {
+		for i := range items {
+			line, err := readLine(r)
+			if err != nil {
+				return err
+			}
+			switch {
+			case bytes.Equal(line, memcachedStored):
+			case bytes.Equal(line, memcachedNotStored):
+				errs[i], errsNil = memcache.ErrNotStored, false
+			case bytes.Equal(line, memcachedExists):
+				errs[i], errsNil = memcache.ErrCASConflict, false
+			case bytes.Equal(line, memcachedNotFound):
+				errs[i], errsNil = memcache.ErrNotStored, false
+			default:
+				return memcachedError(line)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// AddMulti adds items that do not already exist on the server.
+func (m *Memcached) AddMulti(c context.Context, items []*Item) error {
+	return m.store(c, "add", items)
+}
+
+// CompareAndSwapMulti replaces items that have not changed since they were got
+// with Memcached.GetMulti.
+func (m *Memcached) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+	return m.store(c, "cas", items)
+}
+
+// SetMulti unconditionally writes items.
+func (m *Memcached) SetMulti(c context.Context, items []*Item) error {
+	return m.store(c, "set", items)
+}
+
+// DeleteMulti removes the items with keys.
+func (m *Memcached) DeleteMulti(c context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	errs := make(appengine.MultiError, len(keys))
+	errsNil := true
+	err := m.pool.do(c, func(w *bufio.Writer) error {
+		for _, key := range keys {
+			if _, err := fmt.Fprintf(w, "delete %s\r\n",
+				memcachedKey(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(r *bufio.Reader) error {
+		for i := range keys {
+			line, err := readLine(r)
+			if err != nil {
+				return err
+			}
+			switch {
+			case bytes.Equal(line, memcachedDeleted):
+			case bytes.Equal(line, memcachedNotFound):
+				errs[i], errsNil = memcache.ErrCacheMiss, false
+			default:
+				return memcachedError(line)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// GetMulti gets the items that exist for keys. Each item carries its CAS
+// value so that it can be passed to CompareAndSwapMulti.
+func (m *Memcached) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	items := make(map[string]*Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+
+	serverKeys := make(map[string]string, len(keys))
+	for _, key := range keys {
+		serverKeys[memcachedKey(key)] = key
+	}
+
+	err := m.pool.do(c, func(w *bufio.Writer) error {
+		w.WriteString("gets")
+		for serverKey := range serverKeys {
+			w.WriteString(" " + serverKey)
+		}
+		_, err := w.WriteString("\r\n")
+		return err
+	}, func(r *bufio.Reader) error {
+		for {
+			line, err := readLine(r)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, memcachedEnd) {
+				return nil
+			}
+
+			// VALUE <key> <flags> <bytes> <cas unique>
+			fields := bytes.Fields(line)
+			if len(fields) != 5 || string(fields[0]) != "VALUE" {
+				return memcachedError(line)
+			}
+			flags, err := strconv.ParseUint(string(fields[2]), 10, 32)
+			if err != nil {
+				return err
+			}
+			size, err := strconv.Atoi(string(fields[3]))
+			if err != nil {
+				return err
+			}
+			casID, err := strconv.ParseUint(string(fields[4]), 10, 64)
+			if err != nil {
+				return err
+			}
+
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			if !bytes.HasSuffix(value, []byte("\r\n")) {
+				return errors.New("nds: malformed memcached value")
+			}
+
+			key, ok := serverKeys[string(fields[1])]
+			if !ok {
+				return memcachedError(line)
+			}
+			item := &Item{
+				Key:   key,
+				Value: value[:size],
+				Flags: uint32(flags),
+			}
+			item.SetCASInfo(casID)
+			items[key] = item
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -0,0 +1,279 @@
+package nds_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// memcachedServer is an in process server that speaks enough of the
+// memcached text protocol to test nds.Memcached.
+type memcachedServer struct {
+	ln net.Listener
+
+	sync.Mutex
+	items map[string]memcachedItem
+	cas   uint64
+}
+
+type memcachedItem struct {
+	value []byte
+	flags uint32
+	cas   uint64
+}
+
+func newMemcachedServer(t *testing.T) *memcachedServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &memcachedServer{
+		ln:    ln,
+		items: map[string]memcachedItem{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *memcachedServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *memcachedServer) close() {
+	s.ln.Close()
+}
+
+func (s *memcachedServer) item(key string) (memcachedItem, bool) {
+	s.Lock()
+	defer s.Unlock()
+	item, ok := s.items[key]
+	return item, ok
+}
+
+func (s *memcachedServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+
+		switch fields[0] {
+		case "gets":
+			s.Lock()
+			for _, key := range fields[1:] {
+				if item, ok := s.items[key]; ok {
+					fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key,
+						item.flags, len(item.value), item.cas, item.value)
+				}
+			}
+			s.Unlock()
+			w.WriteString("END\r\n")
+		case "add", "set", "cas":
+			flags, _ := strconv.ParseUint(fields[2], 10, 32)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			w.WriteString(s.store(fields, value[:size], uint32(flags)))
+		case "delete":
+			s.Lock()
+			if _, ok := s.items[fields[1]]; ok {
+				delete(s.items, fields[1])
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+			s.Unlock()
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *memcachedServer) store(fields []string, value []byte,
+	flags uint32) string {
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := fields[1]
+	item, exists := s.items[key]
+	switch fields[0] {
+	case "add":
+		if exists {
+			return "NOT_STORED\r\n"
+		}
+	case "cas":
+		if !exists {
+			return "NOT_FOUND\r\n"
+		}
+		if cas, _ := strconv.ParseUint(fields[5], 10, 64); cas != item.cas {
+			return "EXISTS\r\n"
+		}
+	}
+	s.cas++
+	s.items[key] = memcachedItem{value: value, flags: flags, cas: s.cas}
+	return "STORED\r\n"
+}
+
+func TestMemcached(t *testing.T) {
+	s := newMemcachedServer(t)
+	defer s.close()
+
+	c := context.Background()
+	m := nds.NewMemcached(s.addr(), time.Second)
+
+	longKey := strings.Repeat("k", 300) + " with spaces"
+	items := []*nds.Item{
+		{Key: "one", Value: []byte("1"), Flags: nds.EntityItem},
+		{Key: longKey, Value: []byte("2"), Flags: nds.LockItem},
+	}
+	if err := m.AddMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.AddMulti(c, items[:1])
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrNotStored {
+		t.Fatal("expected memcache.ErrNotStored", err)
+	}
+
+	got, err := m.GetMulti(c, []string{"one", longKey, "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatal("expected 2 items", len(got))
+	}
+	for _, item := range items {
+		if g := got[item.Key]; g == nil || g.Flags != item.Flags ||
+			!bytes.Equal(g.Value, item.Value) {
+			t.Fatal("expected item", item.Key, g)
+		}
+	}
+
+	// Only the first compare-and-swap of an item should succeed.
+	got["one"].Value = []byte("3")
+	if err := m.CompareAndSwapMulti(c,
+		[]*nds.Item{got["one"]}); err != nil {
+		t.Fatal(err)
+	}
+	err = m.CompareAndSwapMulti(c, []*nds.Item{got["one"]})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCASConflict {
+		t.Fatal("expected memcache.ErrCASConflict", err)
+	}
+
+	if err := m.CompareAndSwapMulti(c, items[:1]); err == nil {
+		t.Fatal("expected error for item not got with Memcached")
+	}
+
+	if err := m.SetMulti(c, []*nds.Item{
+		{Key: "one", Value: []byte("4")}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = m.GetMulti(c, []string{"one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got["one"].Value) != "4" {
+		t.Fatal("expected set value", string(got["one"].Value))
+	}
+
+	if err := m.DeleteMulti(c, []string{"one", longKey}); err != nil {
+		t.Fatal(err)
+	}
+	err = m.DeleteMulti(c, []string{"one"})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+}
+
+func TestMemcachedCache(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	s := newMemcachedServer(t)
+	defer s.close()
+
+	nds.SetCache(nds.NewMemcached(s.addr(), time.Second))
+	defer nds.SetCache(nds.Memcache{})
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.item(nds.CreateMemcacheKey(c, key)); ok {
+		t.Fatal("expected lock to be removed")
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	item, ok := s.item(nds.CreateMemcacheKey(c, key))
+	if !ok || item.flags != nds.EntityItem {
+		t.Fatal("expected entity item", item.flags)
+	}
+
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	item, ok = s.item(nds.CreateMemcacheKey(c, key))
+	if !ok || item.flags != nds.LockItem {
+		t.Fatal("expected lock item", item.flags)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
@@ -0,0 +1,283 @@
+package nds
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"google.golang.org/appengine"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	// memcachePrefix is the namespace memcache uses to store entities.
+	memcachePrefix = "NDS2:"
+
+	// memcacheLockTime is the maximum length of time a memcache lock will be
+	// held for. 32 seconds is choosen as 30 seconds is the maximum amount of
+	// time an underlying datastore call will retry even if the API reports a
+	// success to the user.
+	memcacheLockTime = 32 * time.Second
+)
+
+var (
+	typeOfPropertyLoadSaver = reflect.TypeOf(
+		(*datastore.PropertyLoadSaver)(nil)).Elem()
+	typeOfPropertyList = reflect.TypeOf(datastore.PropertyList(nil))
+)
+
+// The variables in this block are here so that we can test all error code
+// paths by substituting the respective functions with error producing ones.
+var (
+	datastoreDeleteMulti = datastore.DeleteMulti
+	datastoreGetMulti    = datastore.GetMulti
+	datastorePutMulti    = datastore.PutMulti
+
+	// Memcache calls are replaced with ones that don't hit the backend service
+	// if len(keys) or len(items) == 0. This should be changed once issue
+	// http://goo.gl/AW96Fi has been resolved with the Go App Engine SDK.
+	memcacheAddMulti            = zeroMemcacheAddMulti
+	memcacheCompareAndSwapMulti = zeroMemcacheCompareAndSwapMulti
+	memcacheDeleteMulti         = zeroMemcacheDeleteMulti
+	memcacheGetMulti            = zeroMemcacheGetMulti
+	memcacheSetMulti            = zeroMemcacheSetMulti
+
+	marshal   = marshalPropertyList
+	unmarshal = unmarshalPropertyList
+)
+
+// The following memcache functions are enclosed to ensure the underlying
+// App Engine service is not called when there are no keys or items to be
+// called with. The datastore calls do not need this because they already check
+// for this condition and short-circuit.
+func zeroMemcacheAddMulti(c context.Context, items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return memcache.AddMulti(c, items)
+}
+
+func zeroMemcacheCompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return memcache.CompareAndSwapMulti(c, items)
+}
+
+func zeroMemcacheGetMulti(c context.Context, keys []string) (
+	map[string]*memcache.Item, error) {
+	if len(keys) == 0 {
+		return make(map[string]*memcache.Item, 0), nil
+	}
+	return memcache.GetMulti(c, keys)
+}
+
+func zeroMemcacheDeleteMulti(c context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return memcache.DeleteMulti(c, keys)
+}
+
+func zeroMemcacheSetMulti(c context.Context, items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return memcache.SetMulti(c, items)
+}
+
+const (
+	noneItem uint32 = iota
+	entityItem
+	lockItem
+	compressedEntityItem
+	manifestItem
+	chunkItem
+	generationItem
+)
+
+func itemLock() []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, rand.Uint32())
+	return b
+}
+
+func checkMultiArgs(keys []*datastore.Key, v reflect.Value) error {
+	if v.Kind() != reflect.Slice {
+		return errors.New("nds: vals is not a slice")
+	}
+
+	if len(keys) != v.Len() {
+		return errors.New("nds: keys and vals slices have different length")
+	}
+
+	isNilErr, nilErr := false, make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidKey
+		}
+	}
+	if isNilErr {
+		return nilErr
+	}
+
+	if v.Type() == typeOfPropertyList {
+		return errors.New("nds: PropertyList not supported")
+	}
+
+	elemType := v.Type().Elem()
+	if reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) {
+		return nil
+	}
+
+	switch elemType.Kind() {
+	case reflect.Struct:
+		return nil
+	case reflect.Interface:
+		return checkNilPropertyLists(v)
+	case reflect.Ptr:
+		elemType = elemType.Elem()
+		if elemType.Kind() == reflect.Struct {
+			return nil
+		}
+		if elemType == typeOfPropertyList {
+			return checkNilPropertyLists(v)
+		}
+	}
+	return errors.New("nds: unsupported vals type")
+}
+
+// checkNilPropertyLists returns datastore.ErrInvalidEntityType for each
+// element of v that is a nil *datastore.PropertyList, as there is nothing to
+// load into or save from them.
+func checkNilPropertyLists(v reflect.Value) error {
+	isNilErr, nilErr := false, make(appengine.MultiError, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		pl, ok := v.Index(i).Interface().(*datastore.PropertyList)
+		if ok && pl == nil {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidEntityType
+		}
+	}
+	if isNilErr {
+		return nilErr
+	}
+	return nil
+}
+
+// datastoreVals returns the vals slice v in a form accepted by the datastore
+// package. The datastore package does not support []*datastore.PropertyList
+// so it is converted to an []interface{} of the same PropertyList pointers.
+func datastoreVals(v reflect.Value) interface{} {
+	if v.Type().Elem() != reflect.PtrTo(typeOfPropertyList) {
+		return v.Interface()
+	}
+
+	vals := make([]interface{}, v.Len())
+	for i := range vals {
+		vals[i] = v.Index(i).Interface()
+	}
+	return vals
+}
+
+// SaveStruct saves src to a datastore.PropertyList. src must be a struct
+// pointer.
+func SaveStruct(src interface{}, pl *datastore.PropertyList) error {
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return err
+	}
+	*pl = append(*pl, props...)
+	return nil
+}
+
+// LoadStruct loads a datastore.PropertyList into dst. dst must be a struct
+// pointer.
+func LoadStruct(dst interface{}, pl datastore.PropertyList) error {
+	return datastore.LoadStruct(dst, pl)
+}
+
+func propertyLoadSaverToPropertyList(
+	pls datastore.PropertyLoadSaver, pl *datastore.PropertyList) error {
+	props, err := pls.Save()
+	if err != nil {
+		return err
+	}
+	*pl = append(*pl, props...)
+	return nil
+}
+
+func propertyListToPropertyLoadSaver(
+	pl datastore.PropertyList, pls datastore.PropertyLoadSaver) error {
+	return pls.Load(pl)
+}
+
+func marshalPropertyList(pl datastore.PropertyList) ([]byte, error) {
+	return encodePropertyList(pl)
+}
+
+// unmarshalPropertyList decodes data written by marshalPropertyList.
+func unmarshalPropertyList(data []byte, pl *datastore.PropertyList) error {
+	return decodePropertyList(data, pl)
+}
+
+// saveValue saves val, a valid element of a PutMulti vals slice, to pl. The
+// values in pl are normalised so that pl matches the entity a get from the
+// datastore would return.
+func saveValue(val reflect.Value, pl *datastore.PropertyList) error {
+
+	if reflect.PtrTo(val.Type()).Implements(typeOfPropertyLoadSaver) {
+		val = val.Addr()
+	}
+
+	var err error
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		err = propertyLoadSaverToPropertyList(pls, pl)
+	} else {
+		if val.Kind() == reflect.Struct {
+			val = val.Addr()
+		}
+		err = SaveStruct(val.Interface(), pl)
+	}
+	if err != nil {
+		return err
+	}
+
+	normalizeProperties(*pl)
+	return nil
+}
+
+// normalizeProperties converts the values in pl to the form the datastore
+// stores them in. Times are stored with microsecond precision and are loaded
+// in UTC.
+func normalizeProperties(pl datastore.PropertyList) {
+	for i, p := range pl {
+		if t, ok := p.Value.(time.Time); ok {
+			pl[i].Value = time.Unix(t.Unix(),
+				int64(t.Nanosecond()/1e3*1e3)).UTC()
+		}
+	}
+}
+
+func setValue(val reflect.Value, pl datastore.PropertyList) error {
+
+	if reflect.PtrTo(val.Type()).Implements(typeOfPropertyLoadSaver) {
+		val = val.Addr()
+	}
+
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		return propertyListToPropertyLoadSaver(pl, pls)
+	}
+
+	if val.Kind() == reflect.Struct {
+		val = val.Addr()
+	}
+	return LoadStruct(val.Interface(), pl)
+}
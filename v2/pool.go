@@ -0,0 +1,114 @@
+package nds
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// poolMaxIdleConns is the number of idle connections a connPool keeps
+	// open to its server.
+	poolMaxIdleConns = 8
+
+	// poolTimeout is the default time allowed for each call to a server,
+	// including dialing.
+	poolTimeout = 5 * time.Second
+)
+
+// connPool is a pool of TCP connections to a single cache server. It is used
+// by the cache backends that do not run on App Engine.
+type connPool struct {
+	addr    string
+	timeout time.Duration
+
+	sync.Mutex
+	conns []*poolConn
+}
+
+type poolConn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+func newConnPool(addr string, timeout time.Duration) *connPool {
+	if timeout == 0 {
+		timeout = poolTimeout
+	}
+	return &connPool{
+		addr:    addr,
+		timeout: timeout,
+	}
+}
+
+func (p *connPool) get(c context.Context) (*poolConn, error) {
+	deadline := time.Now().Add(p.timeout)
+	if d, ok := c.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	p.Lock()
+	var cn *poolConn
+	if n := len(p.conns); n > 0 {
+		cn = p.conns[n-1]
+		p.conns = p.conns[:n-1]
+	}
+	p.Unlock()
+
+	if cn == nil {
+		nc, err := net.DialTimeout("tcp", p.addr, deadline.Sub(time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		cn = &poolConn{
+			nc: nc,
+			rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+		}
+	}
+
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		cn.nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put returns cn to the pool if err is nil. Otherwise the connection may be
+// part way through a response so it is closed.
+func (p *connPool) put(cn *poolConn, err error) {
+	if err == nil {
+		p.Lock()
+		if len(p.conns) < poolMaxIdleConns {
+			p.conns = append(p.conns, cn)
+			cn = nil
+		}
+		p.Unlock()
+	}
+	if cn != nil {
+		cn.nc.Close()
+	}
+}
+
+// do sends the commands written by write and then reads their responses with
+// read. Commands are pipelined so each call makes one round trip.
+func (p *connPool) do(c context.Context, write func(w *bufio.Writer) error,
+	read func(r *bufio.Reader) error) (err error) {
+
+	cn, err := p.get(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		p.put(cn, err)
+	}()
+
+	if err := write(cn.rw.Writer); err != nil {
+		return err
+	}
+	if err := cn.rw.Flush(); err != nil {
+		return err
+	}
+	return read(cn.rw.Reader)
+}
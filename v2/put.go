@@ -0,0 +1,219 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// putMultiLimit is the App Engine datastore limit for the maximum number
+// of entities that can be put by the datastore.PutMulti at once.
+// nds.PutMulti increases this limit by performing as many
+// datastore.PutMulti as required concurrently and collating the results.
+const putMultiLimit = 500
+
+// PutMulti is a batch version of Put. It works just like datastore.PutMulti
+// except it interacts appropriately with NDS's caching strategy. It also
+// removes the API limit of 500 entities per request by calling the datastore as
+// many times as required to put all the keys. It does this efficiently and
+// concurrently.
+//
+// vals may be any type accepted by datastore.PutMulti as well as
+// []*datastore.PropertyList.
+func PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	return defaultClient.PutMulti(c, keys, vals)
+}
+
+// PutMulti works like the package level PutMulti using the Client's Options.
+func (cl *Client) PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+
+	v := reflect.ValueOf(vals)
+	if err := checkMultiArgs(keys, v); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return []*datastore.Key{}, nil
+	}
+
+	limit := cl.putMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
+	putKeys := make([][]*datastore.Key, callCount)
+	errs := make([]error, callCount)
+
+	wg := sync.WaitGroup{}
+	wg.Add(callCount)
+	for i := 0; i < callCount; i++ {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		index := i
+		keySlice := keys[lo:hi]
+		valSlice := v.Slice(lo, hi)
+
+		go func() {
+			putKeys[index], errs[index] = cl.putMulti(c,
+				keySlice, datastoreVals(valSlice))
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	// Quick escape if all errors are nil.
+	errsNil := true
+	for _, err := range errs {
+		if err != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		groupedKeys := make([]*datastore.Key, 0, len(keys))
+		for _, k := range putKeys {
+			groupedKeys = append(groupedKeys, k...)
+		}
+		return groupedKeys, nil
+	}
+
+	groupedErrs := make(appengine.MultiError, len(keys))
+	for i, err := range errs {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		if me, ok := err.(appengine.MultiError); ok {
+			copy(groupedErrs[lo:hi], me)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return nil, groupedErrs
+}
+
+// Put saves the entity val into the datastore with key. val must be a struct
+// pointer; if a struct pointer then any unexported fields of that struct will
+// be skipped. If key is an incomplete key, the returned key will be a unique
+// key generated by the datastore.
+func Put(c context.Context,
+	key *datastore.Key, val interface{}) (*datastore.Key, error) {
+	return defaultClient.Put(c, key, val)
+}
+
+// Put works like the package level Put using the Client's Options.
+func (cl *Client) Put(c context.Context,
+	key *datastore.Key, val interface{}) (*datastore.Key, error) {
+
+	keys, err := cl.PutMulti(c, []*datastore.Key{key}, []interface{}{val})
+	switch e := err.(type) {
+	case nil:
+		return keys[0], nil
+	case appengine.MultiError:
+		return nil, e[0]
+	default:
+		return nil, err
+	}
+}
+
+// putMulti puts the entities into the datastore and then its local cache.
+func (cl *Client) putMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+
+	// Entities are locked with the transaction's Client so that their
+	// cache keys match those it removes once it commits.
+	if txc, ok := transactionContext(c); ok && txc.client != cl {
+		return txc.client.putMulti(c, keys, vals)
+	}
+
+	gens, err := cl.loadGenerations(c, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	lockKeys := make([]*datastore.Key, 0, len(keys))
+	lockMemcacheKeys := make([]string, 0, len(keys))
+	lockMemcacheItems := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		if !key.Incomplete() {
+			item := &Item{
+				Key:        cl.createMemcacheKey(gens, key),
+				Flags:      lockItem,
+				Value:      itemLock(),
+				Expiration: cl.lockTime(),
+			}
+			lockKeys = append(lockKeys, key)
+			lockMemcacheItems = append(lockMemcacheItems, item)
+			lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
+		}
+	}
+
+	if txc, ok := transactionContext(c); ok {
+		txc.Lock()
+		txc.lockKeys = append(txc.lockKeys, lockKeys...)
+		txc.lockMemcacheItems = append(txc.lockMemcacheItems,
+			lockMemcacheItems...)
+		txc.Unlock()
+	} else if err := cache.SetMulti(c, append(cl.legacyLockItems(lockKeys),
+		lockMemcacheItems...)); err != nil {
+		return nil, err
+	}
+
+	// Save to the datastore.
+	dsKeys, err := datastoreBackend.PutMulti(c, keys, vals)
+
+	if txc, ok := transactionContext(c); ok {
+		if err == nil {
+			txc.put(dsKeys, reflect.ValueOf(vals), nil)
+		} else {
+			txc.put(keys, reflect.ValueOf(vals), err)
+		}
+	}
+
+	if lc, ok := localCacheContext(c); ok {
+		lc.evict(cl.localCacheKeys(lockKeys))
+	}
+
+	// Transactions remove their locks once they have committed.
+	if _, ok := transactionContext(c); ok {
+		if err != nil {
+			return nil, err
+		}
+		return dsKeys, nil
+	}
+
+	// Entities may have been cached under a new generation while they were
+	// being put. Those items were not locked so they must be removed even if
+	// the put failed.
+	changedKeys := cl.changedMemcacheKeys(c, lockKeys, lockMemcacheKeys)
+	if err != nil {
+		if err := cache.DeleteMulti(c, changedKeys); err != nil {
+			logger.Warningf(c, "putMulti memcache.DeleteMulti %s", err)
+		}
+		return nil, err
+	}
+
+	// Earlier versions sharing the cache would not see changes to entities
+	// cached now.
+	if cl.opts.WriteThrough && !legacyCache {
+		lockMemcacheKeys = cl.writeThroughMemcache(c,
+			keys, vals, lockMemcacheItems)
+	}
+	if cl.opts.CacheNewEntities && !legacyCache {
+		cl.addNewEntities(c, gens, keys, dsKeys, vals)
+	}
+
+	// Remove the locks.
+	deleteKeys := append(lockMemcacheKeys, changedKeys...)
+	deleteKeys = append(deleteKeys, legacyMemcacheKeys(lockKeys)...)
+	if err := cache.DeleteMulti(c, deleteKeys); err != nil {
+		logger.Warningf(c, "putMulti memcache.DeleteMulti %s", err)
+	}
+	return dsKeys, nil
+}
@@ -0,0 +1,314 @@
+package nds_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGetAll(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := int64(1); i < 4; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", i, nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure entities are loaded through memcache.
+	getMultiCount := 0
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		getMultiCount++
+		return nds.ZeroMemcacheGetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(nds.ZeroMemcacheGetMulti)
+
+	q := datastore.NewQuery("Entity")
+
+	response := []testEntity{}
+	respKeys, err := nds.GetAll(c, q, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(respKeys) != 3 || len(response) != 3 {
+		t.Fatal("expected 3 results", len(respKeys), len(response))
+	}
+	for i, key := range respKeys {
+		if !key.Equal(keys[i]) {
+			t.Fatal("incorrect key", key)
+		}
+		if response[i].IntVal != int64(i+1) {
+			t.Fatal("incorrect IntVal", response[i].IntVal)
+		}
+	}
+	if getMultiCount == 0 {
+		t.Fatal("expected memcache to be used")
+	}
+
+	// Get from cache with a struct pointer slice.
+	ptrResponse := []*testEntity{}
+	if _, err := nds.GetAll(c, q, &ptrResponse); err != nil {
+		t.Fatal(err)
+	}
+	for i, te := range ptrResponse {
+		if te.IntVal != int64(i+1) {
+			t.Fatal("incorrect IntVal", te.IntVal)
+		}
+	}
+
+	// Keys only.
+	respKeys, err = nds.GetAll(c, q.KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(respKeys) != 3 {
+		t.Fatal("expected 3 keys", len(respKeys))
+	}
+}
+
+func TestGetAllAppend(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	response := []testEntity{testEntity{1}}
+	if _, err := nds.GetAll(c,
+		datastore.NewQuery("Entity"), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 2 {
+		t.Fatal("expected 2 entities", len(response))
+	}
+	if response[0].IntVal != 1 || response[1].IntVal != 2 {
+		t.Fatal("incorrect values", response)
+	}
+}
+
+func TestGetAllDeletedEntity(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	entities := []testEntity{testEntity{1}, testEntity{2}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the query index is stale for the first entity.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		err := datastore.GetMulti(c, keys, vals)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			me = make(appengine.MultiError, len(keys))
+		}
+		for i, key := range keys {
+			if key.IntID() == 1 {
+				me[i] = datastore.ErrNoSuchEntity
+			}
+		}
+		return me
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	response := []testEntity{}
+	respKeys, err := nds.GetAll(c, datastore.NewQuery("Entity"), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(respKeys) != 1 || len(response) != 1 {
+		t.Fatal("expected 1 result", len(respKeys), len(response))
+	}
+	if respKeys[0].IntID() != 2 || response[0].IntVal != 2 {
+		t.Fatal("incorrect result", respKeys[0], response[0])
+	}
+}
+
+func TestGetAllArgs(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	q := datastore.NewQuery("Entity")
+	if _, err := nds.GetAll(c, q, []int{}); err == nil {
+		t.Fatal("expected error for non pointer dst")
+	}
+
+	if _, err := nds.GetAll(c, q, &[]int{}); err == nil {
+		t.Fatal("expected error for unsupported dst")
+	}
+}
+
+func TestRun(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := int64(1); i < 4; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", i, nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	it := nds.Run(c, datastore.NewQuery("Entity"))
+	for i := 0; ; i++ {
+		te := &testEntity{}
+		key, err := it.Next(te)
+		if err == datastore.Done {
+			if i != 3 {
+				t.Fatal("expected 3 results", i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equal(keys[i]) {
+			t.Fatal("incorrect key", key)
+		}
+		if te.IntVal != int64(i+1) {
+			t.Fatal("incorrect IntVal", te.IntVal)
+		}
+	}
+
+	if _, err := it.Cursor(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys only.
+	it = nds.Run(c, datastore.NewQuery("Entity").KeysOnly())
+	count := 0
+	for {
+		if _, err := it.Next(nil); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatal("expected 3 keys", count)
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := int64(1); i <= 60; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", i, nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	getMultiCount := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		getMultiCount++
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	it := nds.Run(c, datastore.NewQuery("Entity"))
+	respKeys := []*datastore.Key{}
+	var cursor datastore.Cursor
+	for {
+		te := &testEntity{}
+		key, err := it.Next(te)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if te.IntVal != key.IntID() {
+			t.Fatal("incorrect IntVal", te.IntVal, key)
+		}
+		respKeys = append(respKeys, key)
+
+		// Part way through the second batch.
+		if len(respKeys) == 55 {
+			if cursor, err = it.Cursor(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(respKeys) != 60 {
+		t.Fatal("expected 60 results", len(respKeys))
+	}
+	if getMultiCount != 2 {
+		t.Fatal("expected 2 datastore GetMulti calls", getMultiCount)
+	}
+
+	it = nds.Run(c, datastore.NewQuery("Entity").Start(cursor))
+	if key, err := it.Next(nil); err != nil {
+		t.Fatal(err)
+	} else if !key.Equal(respKeys[55]) {
+		t.Fatal("incorrect key after cursor", key, respKeys[55])
+	}
+}
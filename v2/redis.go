@@ -0,0 +1,481 @@
+package nds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// redisHeaderSize is the size of the header stored before each item's value.
+// It holds the item's version, which is replaced on every write and used for
+// compare-and-swap, followed by its flags.
+const redisHeaderSize = 12
+
+// redisScript is a Lua script run on the server with EVALSHA.
+type redisScript struct {
+	src string
+	sha string
+}
+
+func newRedisScript(src string) *redisScript {
+	sum := sha1.Sum([]byte(src))
+	return &redisScript{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// redisAddScript sets KEYS[1] to ARGV[1], expiring after ARGV[2] milliseconds
+// unless it is 0, if it does not exist. It returns 1 if the item was added and
+// 0 if it already exists.
+var redisAddScript = newRedisScript(`
+local ok
+if ARGV[2] == '0' then
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+else
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX')
+end
+if ok then
+	return 1
+end
+return 0
+`)
+
+// redisCompareAndSwapScript replaces KEYS[1] with ARGV[2], expiring after
+// ARGV[3] milliseconds unless it is 0, if its version is still ARGV[1]. It
+// returns 1 if the item was replaced, 0 if it has changed and -1 if it no
+// longer exists.
+var redisCompareAndSwapScript = newRedisScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return -1
+end
+if string.sub(v, 1, 8) ~= ARGV[1] then
+	return 0
+end
+if ARGV[3] == '0' then
+	redis.call('SET', KEYS[1], ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return 1
+`)
+
+// Redis is a Cache that uses a Redis server over the Redis protocol in place of
+// App Engine memcache. Use NewRedis to create one.
+//
+// Each item is stored as a Redis string prefixed with a version that changes
+// on every write. Locks are added, and compare-and-swap is performed, by Lua
+// scripts. Redis runs a script without interleaving other commands, so the
+// check that an item does not exist, or that its version is the one the lock
+// was read back with, is atomic with the write that follows it. A get can
+// therefore only replace its own lock, never one that a put or another get has
+// since set. Scripts are loaded once with SCRIPT LOAD and then called with
+// EVALSHA, and are loaded again if the server replies NOSCRIPT, for example
+// after a restart. Redis connects to a single server and does not follow
+// Redis Cluster MOVED or ASK redirects, so it cannot be used with a cluster.
+//
+// Per item failures are returned as an appengine.MultiError containing
+// memcache.ErrNotStored, memcache.ErrCASConflict or memcache.ErrCacheMiss, the
+// same errors as the Memcache Cache.
+type Redis struct {
+	pool *connPool
+
+	sync.Mutex
+	loaded map[*redisScript]bool
+}
+
+// NewRedis returns a Redis that connects to the Redis server at addr, for
+// example "localhost:6379". Each call to the server, including dialing, is
+// allowed timeout or the time left before the context's deadline, whichever is
+// shorter. A zero timeout selects a default of five seconds.
+func NewRedis(addr string, timeout time.Duration) *Redis {
+	return &Redis{
+		pool:   newConnPool(addr, timeout),
+		loaded: map[*redisScript]bool{},
+	}
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "nds: redis error " + string(e)
+}
+
+// writeRedisCommand writes a command as an array of bulk strings.
+func writeRedisCommand(w *bufio.Writer, args ...[]byte) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.Write(arg)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRedisReply reads a reply. Simple strings are returned as a string,
+// errors as a redisError, integers as an int64, bulk strings as a []byte which
+// is nil if the reply is null and arrays as a []interface{}.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("nds: malformed redis reply")
+	}
+	kind, body := line[0], string(line[1:len(line)-2])
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return []byte(nil), nil
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:size], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, errors.New("nds: malformed redis reply")
+}
+
+// redisValue returns the value stored for item with a new version.
+func redisValue(item *Item) []byte {
+	b := make([]byte, redisHeaderSize+len(item.Value))
+	binary.LittleEndian.PutUint64(b, rand.Uint64())
+	binary.LittleEndian.PutUint32(b[8:], item.Flags)
+	copy(b[redisHeaderSize:], item.Value)
+	return b
+}
+
+// redisExpiration returns d in milliseconds. Zero means no expiration.
+func redisExpiration(d time.Duration) int64 {
+	switch {
+	case d <= 0:
+		return 0
+	case d < time.Millisecond:
+		return 1
+	}
+	return int64(d / time.Millisecond)
+}
+
+// pipeline sends a command for each of n items and passes each reply,
+// including error replies, to f.
+func (r *Redis) pipeline(c context.Context, n int,
+	command func(i int) [][]byte, f func(i int, reply interface{})) error {
+
+	return r.pool.do(c, func(w *bufio.Writer) error {
+		for i := 0; i < n; i++ {
+			if err := writeRedisCommand(w, command(i)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(br *bufio.Reader) error {
+		for i := 0; i < n; i++ {
+			reply, err := readRedisReply(br)
+			if err != nil {
+				return err
+			}
+			f(i, reply)
+		}
+		return nil
+	})
+}
+
+// do pipelines a command for each of n items and passes each reply to f,
+// which returns the item's error. Error replies fail the whole call.
+func (r *Redis) do(c context.Context, n int, command func(i int) [][]byte,
+	f func(i int, reply interface{}) error) error {
+
+	if n == 0 {
+		return nil
+	}
+
+	errs := make(appengine.MultiError, n)
+	errsNil := true
+	var replyErr error
+	err := r.pipeline(c, n, command, func(i int, reply interface{}) {
+		if e, ok := reply.(redisError); ok {
+			replyErr = e
+			return
+		}
+		if errs[i] = f(i, reply); errs[i] != nil {
+			errsNil = false
+		}
+	})
+	if err == nil {
+		err = replyErr
+	}
+	if err != nil {
+		return err
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// redisNoScript reports whether reply is the error the server replies with
+// when it does not have a script.
+func redisNoScript(reply interface{}) bool {
+	e, ok := reply.(redisError)
+	return ok && strings.HasPrefix(string(e), "NOSCRIPT")
+}
+
+// loadScript loads s onto the server with SCRIPT LOAD.
+func (r *Redis) loadScript(c context.Context, s *redisScript) error {
+	var replyErr error
+	err := r.pipeline(c, 1, func(i int) [][]byte {
+		return [][]byte{[]byte("SCRIPT"), []byte("LOAD"), []byte(s.src)}
+	}, func(i int, reply interface{}) {
+		if b, ok := reply.([]byte); !ok || string(b) != s.sha {
+			replyErr = fmt.Errorf("nds: unexpected redis reply %v",
+				reply)
+		}
+	})
+	if err == nil {
+		err = replyErr
+	}
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.loaded[s] = true
+	r.Unlock()
+	return nil
+}
+
+// eval works like do but runs s with EVALSHA for each of n items. args returns
+// the number of keys, the keys and the arguments for item i. s is loaded
+// before it is first used and again for items that the server replies
+// NOSCRIPT to.
+func (r *Redis) eval(c context.Context, s *redisScript, n int,
+	args func(i int) [][]byte,
+	f func(i int, reply interface{}) error) error {
+
+	if n == 0 {
+		return nil
+	}
+
+	r.Lock()
+	loaded := r.loaded[s]
+	r.Unlock()
+	if !loaded {
+		if err := r.loadScript(c, s); err != nil {
+			return err
+		}
+	}
+
+	index := make([]int, n)
+	for i := range index {
+		index[i] = i
+	}
+
+	errs := make(appengine.MultiError, n)
+	errsNil := true
+	for retry := false; ; retry = true {
+		noScript := []int{}
+		var replyErr error
+		err := r.pipeline(c, len(index), func(j int) [][]byte {
+			command := [][]byte{[]byte("EVALSHA"), []byte(s.sha)}
+			return append(command, args(index[j])...)
+		}, func(j int, reply interface{}) {
+			i := index[j]
+			if redisNoScript(reply) && !retry {
+				noScript = append(noScript, i)
+				return
+			}
+			if e, ok := reply.(redisError); ok {
+				replyErr = e
+				return
+			}
+			if errs[i] = f(i, reply); errs[i] != nil {
+				errsNil = false
+			}
+		})
+		if err == nil {
+			err = replyErr
+		}
+		if err != nil {
+			return err
+		}
+		if len(noScript) == 0 {
+			break
+		}
+
+		// The server has lost the script, for example after a restart.
+		if err := r.loadScript(c, s); err != nil {
+			return err
+		}
+		index = noScript
+	}
+
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// AddMulti adds items that do not already exist on the server.
+func (r *Redis) AddMulti(c context.Context, items []*Item) error {
+	return r.eval(c, redisAddScript, len(items), func(i int) [][]byte {
+		return [][]byte{
+			[]byte("1"), []byte(items[i].Key), redisValue(items[i]),
+			[]byte(strconv.FormatInt(redisExpiration(items[i].Expiration), 10)),
+		}
+	}, func(i int, reply interface{}) error {
+		switch reply {
+		case int64(1):
+			return nil
+		case int64(0):
+			return memcache.ErrNotStored
+		}
+		return fmt.Errorf("nds: unexpected redis reply %v", reply)
+	})
+}
+
+// CompareAndSwapMulti replaces items that have not changed since they were got
+// with Redis.GetMulti.
+func (r *Redis) CompareAndSwapMulti(c context.Context, items []*Item) error {
+	versions := make([][]byte, len(items))
+	for i, item := range items {
+		version, ok := item.GetCASInfo().([]byte)
+		if !ok {
+			return errors.New("nds: item was not got with Redis")
+		}
+		versions[i] = version
+	}
+
+	args := func(i int) [][]byte {
+		return [][]byte{
+			[]byte("1"), []byte(items[i].Key), versions[i],
+			redisValue(items[i]),
+			[]byte(strconv.FormatInt(redisExpiration(items[i].Expiration), 10)),
+		}
+	}
+	return r.eval(c, redisCompareAndSwapScript, len(items), args,
+		func(i int, reply interface{}) error {
+			switch reply {
+			case int64(1):
+				return nil
+			case int64(0):
+				return memcache.ErrCASConflict
+			case int64(-1):
+				return memcache.ErrNotStored
+			}
+			return fmt.Errorf("nds: unexpected redis reply %v", reply)
+		})
+}
+
+// SetMulti unconditionally writes items.
+func (r *Redis) SetMulti(c context.Context, items []*Item) error {
+	return r.do(c, len(items), func(i int) [][]byte {
+		command := [][]byte{
+			[]byte("SET"), []byte(items[i].Key), redisValue(items[i]),
+		}
+		if ms := redisExpiration(items[i].Expiration); ms > 0 {
+			command = append(command,
+				[]byte("PX"), []byte(strconv.FormatInt(ms, 10)))
+		}
+		return command
+	}, func(i int, reply interface{}) error {
+		return nil
+	})
+}
+
+// DeleteMulti removes the items with keys.
+func (r *Redis) DeleteMulti(c context.Context, keys []string) error {
+	return r.do(c, len(keys), func(i int) [][]byte {
+		return [][]byte{[]byte("DEL"), []byte(keys[i])}
+	}, func(i int, reply interface{}) error {
+		if reply == int64(0) {
+			return memcache.ErrCacheMiss
+		}
+		return nil
+	})
+}
+
+// GetMulti gets the items that exist for keys. Each item carries its version
+// so that it can be passed to CompareAndSwapMulti.
+func (r *Redis) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	items := make(map[string]*Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+
+	err := r.do(c, len(keys), func(i int) [][]byte {
+		return [][]byte{[]byte("GET"), []byte(keys[i])}
+	}, func(i int, reply interface{}) error {
+		b, ok := reply.([]byte)
+		if !ok {
+			return fmt.Errorf("nds: unexpected redis reply %v", reply)
+		}
+		if b == nil {
+			return nil
+		}
+		if len(b) < redisHeaderSize {
+			return errors.New("nds: malformed redis item")
+		}
+		item := &Item{
+			Key:   keys[i],
+			Value: b[redisHeaderSize:],
+			Flags: binary.LittleEndian.Uint32(b[8:]),
+		}
+		item.SetCASInfo(b[:8])
+		items[keys[i]] = item
+		return nil
+	})
+
+	// Items that could not be read are treated as misses.
+	if _, ok := err.(appengine.MultiError); ok {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
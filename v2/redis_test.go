@@ -0,0 +1,401 @@
+package nds_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// redisServer is an in process server that speaks enough of the Redis
+// protocol to test nds.Redis. It runs the add and compare-and-swap scripts
+// natively once they have been loaded. Set NDS_REDIS_ADDR to test against a
+// real Redis server instead.
+type redisServer struct {
+	ln net.Listener
+
+	sync.Mutex
+	values  map[string][]byte
+	scripts map[string]string
+}
+
+func newRedisServer(t *testing.T) *redisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &redisServer{
+		ln:      ln,
+		values:  map[string][]byte{},
+		scripts: map[string]string{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// redisAddr returns the address of the Redis server to test against and a
+// function that stops it.
+func redisAddr(t *testing.T) (string, func()) {
+	if addr := os.Getenv("NDS_REDIS_ADDR"); addr != "" {
+		return addr, func() {}
+	}
+	s := newRedisServer(t)
+	return s.ln.Addr().String(), func() { s.ln.Close() }
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func (s *redisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			if v, ok := s.values[args[1]]; ok {
+				fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				w.WriteString("$-1\r\n")
+			}
+		case "SET":
+			nx := len(args) > 3 && args[len(args)-1] == "NX"
+			if _, ok := s.values[args[1]]; ok && nx {
+				w.WriteString("$-1\r\n")
+			} else {
+				s.values[args[1]] = []byte(args[2])
+				w.WriteString("+OK\r\n")
+			}
+		case "DEL":
+			if _, ok := s.values[args[1]]; ok {
+				delete(s.values, args[1])
+				w.WriteString(":1\r\n")
+			} else {
+				w.WriteString(":0\r\n")
+			}
+		case "SCRIPT":
+			switch strings.ToUpper(args[1]) {
+			case "LOAD":
+				sum := sha1.Sum([]byte(args[2]))
+				sha := hex.EncodeToString(sum[:])
+				s.scripts[sha] = args[2]
+				fmt.Fprintf(w, "$%d\r\n%s\r\n", len(sha), sha)
+			case "FLUSH":
+				s.scripts = map[string]string{}
+				w.WriteString("+OK\r\n")
+			}
+		case "EVALSHA":
+			s.evalSHA(w, args)
+		default:
+			w.WriteString("-ERR unknown command\r\n")
+		}
+		s.Unlock()
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// evalSHA runs a script loaded with SCRIPT LOAD. The add script is told apart
+// from the compare-and-swap script by its use of NX.
+func (s *redisServer) evalSHA(w *bufio.Writer, args []string) {
+	script, ok := s.scripts[args[1]]
+	if !ok {
+		w.WriteString("-NOSCRIPT No matching script.\r\n")
+		return
+	}
+
+	v, exists := s.values[args[3]]
+	if strings.Contains(script, "NX") {
+		// EVALSHA sha 1 key value expiration
+		if exists {
+			w.WriteString(":0\r\n")
+		} else {
+			s.values[args[3]] = []byte(args[4])
+			w.WriteString(":1\r\n")
+		}
+		return
+	}
+
+	// EVALSHA sha 1 key version value expiration
+	switch {
+	case !exists:
+		w.WriteString(":-1\r\n")
+	case string(v[:8]) != args[4]:
+		w.WriteString(":0\r\n")
+	default:
+		s.values[args[3]] = []byte(args[5])
+		w.WriteString(":1\r\n")
+	}
+}
+
+// flushRedisScripts removes every script loaded on the Redis server at addr
+// as happens when it restarts.
+func flushRedisScripts(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(
+		[]byte("*2\r\n$6\r\nSCRIPT\r\n$5\r\nFLUSH\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "+OK\r\n" {
+		t.Fatal("unexpected reply", line)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	addr, stop := redisAddr(t)
+	defer stop()
+
+	c := context.Background()
+	r := nds.NewRedis(addr, time.Second)
+
+	// Keys are unique so that tests can be repeated against a real server.
+	prefix := fmt.Sprintf("nds-test-%d:", time.Now().UnixNano())
+	one, two := prefix+"one", prefix+"two"
+
+	items := []*nds.Item{
+		{Key: one, Value: []byte("1"), Flags: nds.EntityItem},
+		{Key: two, Value: []byte("2"), Flags: nds.LockItem,
+			Expiration: time.Minute},
+	}
+	if err := r.AddMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	err := r.AddMulti(c, items[:1])
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrNotStored {
+		t.Fatal("expected memcache.ErrNotStored", err)
+	}
+
+	got, err := r.GetMulti(c, []string{one, two, prefix + "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatal("expected 2 items", len(got))
+	}
+	for _, item := range items {
+		if g := got[item.Key]; g == nil || g.Flags != item.Flags ||
+			!bytes.Equal(g.Value, item.Value) {
+			t.Fatal("expected item", item.Key, g)
+		}
+	}
+
+	// Only the first compare-and-swap of an item should succeed.
+	got[one].Value = []byte("3")
+	if err := r.CompareAndSwapMulti(c, []*nds.Item{got[one]}); err != nil {
+		t.Fatal(err)
+	}
+	err = r.CompareAndSwapMulti(c, []*nds.Item{got[one]})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCASConflict {
+		t.Fatal("expected memcache.ErrCASConflict", err)
+	}
+
+	if err := r.CompareAndSwapMulti(c, items[:1]); err == nil {
+		t.Fatal("expected error for item not got with Redis")
+	}
+
+	// Setting an item changes its version even if its value is the same.
+	got, err = r.GetMulti(c, []string{one})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetMulti(c, []*nds.Item{
+		{Key: one, Value: got[one].Value, Flags: got[one].Flags}}); err != nil {
+		t.Fatal(err)
+	}
+	err = r.CompareAndSwapMulti(c, []*nds.Item{got[one]})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCASConflict {
+		t.Fatal("expected memcache.ErrCASConflict", err)
+	}
+
+	if err := r.DeleteMulti(c, []string{one, two}); err != nil {
+		t.Fatal(err)
+	}
+	err = r.DeleteMulti(c, []string{one})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+
+	// A deleted item cannot be swapped.
+	err = r.CompareAndSwapMulti(c, []*nds.Item{got[one]})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrNotStored {
+		t.Fatal("expected memcache.ErrNotStored", err)
+	}
+}
+
+func TestRedisNoScript(t *testing.T) {
+	addr, stop := redisAddr(t)
+	defer stop()
+
+	c := context.Background()
+	r := nds.NewRedis(addr, time.Second)
+
+	prefix := fmt.Sprintf("nds-test-%d:", time.Now().UnixNano())
+	one, two := prefix+"one", prefix+"two"
+
+	if err := r.AddMulti(c, []*nds.Item{{Key: one}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.GetMulti(c, []string{one})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The scripts are loaded again once the server has lost them.
+	flushRedisScripts(t, addr)
+
+	if err := r.AddMulti(c, []*nds.Item{{Key: two}}); err != nil {
+		t.Fatal(err)
+	}
+	got[one].Value = []byte("1")
+	if err := r.CompareAndSwapMulti(c, []*nds.Item{got[one]}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = r.GetMulti(c, []string{one, two})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[one].Value) != "1" {
+		t.Fatal("expected both items", got)
+	}
+	if err := r.DeleteMulti(c, []string{one, two}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	addr, stop := redisAddr(t)
+	defer stop()
+
+	// A new prefix keeps tests against a real server independent.
+	cl, err := nds.NewClient(nds.Options{
+		Prefix: fmt.Sprintf("nds-test-%d:", time.Now().UnixNano()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := nds.NewRedis(addr, time.Second)
+	nds.SetCache(r)
+	defer nds.SetCache(nds.Memcache{})
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 43 {
+		t.Fatal("te.IntVal != 43", te.IntVal)
+	}
+
+	memcacheKey := cl.CreateMemcacheKey(c, key)
+	items, err := r.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := items[memcacheKey]; !ok || item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item", item)
+	}
+
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err = r.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := items[memcacheKey]; !ok || item.Flags != nds.LockItem {
+		t.Fatal("expected lock item", item)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
@@ -0,0 +1,249 @@
+package nds
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// txContext holds the state of an nds transaction. It is stored in the context
+// passed to the function given to RunInTransaction.
+type txContext struct {
+	// client is the Client that runs the transaction. Writes within the
+	// transaction use it so that it can remove their locks on commit.
+	client *Client
+
+	// sync.Mutex protects the fields below as batch calls within a
+	// transaction run concurrently.
+	sync.Mutex
+	lockKeys          []*datastore.Key
+	lockMemcacheItems []*Item
+
+	// entities holds the entities put or deleted within the transaction,
+	// keyed by encoded datastore key, so that they can be got again before
+	// the transaction commits.
+	entities map[string]txEntity
+
+	commitHooks   []func()
+	rollbackHooks []func()
+}
+
+// OnCommit registers f to be called after the transaction tc has committed.
+// tc must be the context passed to the function given to RunInTransaction.
+// Functions registered during an attempt that is retried are discarded, so f
+// is called at most once. Functions are called in the order they were
+// registered.
+func OnCommit(tc context.Context, f func()) error {
+	txc, ok := transactionContext(tc)
+	if !ok {
+		return errors.New("nds: not an nds transaction context")
+	}
+	txc.Lock()
+	txc.commitHooks = append(txc.commitHooks, f)
+	txc.Unlock()
+	return nil
+}
+
+// OnRollback registers f to be called if the transaction tc does not commit.
+// It is called once RunInTransaction has made its final attempt, which
+// includes the case where RunInTransaction returns an error even though the
+// transaction may have committed. tc must be the context passed to the
+// function given to RunInTransaction. Functions registered during an attempt
+// that is retried are discarded.
+func OnRollback(tc context.Context, f func()) error {
+	txc, ok := transactionContext(tc)
+	if !ok {
+		return errors.New("nds: not an nds transaction context")
+	}
+	txc.Lock()
+	txc.rollbackHooks = append(txc.rollbackHooks, f)
+	txc.Unlock()
+	return nil
+}
+
+// txEntity is an entity written within a transaction. A nil pl means the
+// entity was deleted.
+type txEntity struct {
+	pl datastore.PropertyList
+}
+
+// put buffers the entities that have just been put within the transaction.
+// If the put failed the entities are removed from the buffer so that they are
+// got from the datastore instead.
+func (txc *txContext) put(keys []*datastore.Key,
+	vals reflect.Value, err error) {
+
+	txc.Lock()
+	defer txc.Unlock()
+
+	for i, key := range keys {
+		if key.Incomplete() {
+			continue
+		}
+		delete(txc.entities, key.Encode())
+		if err != nil {
+			continue
+		}
+
+		pl := datastore.PropertyList{}
+		if saveValue(vals.Index(i), &pl) == nil {
+			txc.entities[key.Encode()] = txEntity{pl: pl}
+		}
+	}
+}
+
+// delete buffers the entities that have just been deleted within the
+// transaction.
+func (txc *txContext) delete(keys []*datastore.Key, err error) {
+	txc.Lock()
+	defer txc.Unlock()
+
+	me, _ := err.(appengine.MultiError)
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		delete(txc.entities, key.Encode())
+		if err == nil || (me != nil && me[i] == nil) {
+			txc.entities[key.Encode()] = txEntity{}
+		}
+	}
+}
+
+// getMulti gets the entities from the transaction's buffer if they were
+// written within the transaction and from the datastore otherwise.
+func (txc *txContext) getMulti(c context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	errs := make(appengine.MultiError, len(keys))
+	errsNil := true
+
+	dsIndex := make([]int, 0, len(keys))
+	txc.Lock()
+	for i, key := range keys {
+		entity, ok := txc.entities[key.Encode()]
+		switch {
+		case !ok:
+			dsIndex = append(dsIndex, i)
+		case entity.pl == nil:
+			errs[i], errsNil = datastore.ErrNoSuchEntity, false
+		default:
+			if err := setValue(vals.Index(i), entity.pl); err != nil {
+				errs[i], errsNil = err, false
+			}
+		}
+	}
+	txc.Unlock()
+
+	if len(dsIndex) == len(keys) {
+		return datastoreBackend.GetMulti(c, keys, datastoreVals(vals))
+	}
+
+	if len(dsIndex) > 0 {
+		dsKeys := make([]*datastore.Key, len(dsIndex))
+		dsVals := reflect.MakeSlice(vals.Type(), len(dsIndex), len(dsIndex))
+		for j, i := range dsIndex {
+			dsKeys[j] = keys[i]
+			dsVals.Index(j).Set(vals.Index(i))
+		}
+
+		err := datastoreBackend.GetMulti(c, dsKeys,
+			datastoreVals(dsVals))
+		me, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+		for j, i := range dsIndex {
+			vals.Index(i).Set(dsVals.Index(j))
+			if ok && me[j] != nil {
+				errs[i], errsNil = me[j], false
+			}
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+func transactionContext(c context.Context) (*txContext, bool) {
+	txc, ok := c.Value(transactionContextKey).(*txContext)
+	return txc, ok
+}
+
+// RunInTransaction works just like datastore.RunInTransaction however it
+// interacts correctly with memcache. You should always use this method for
+// transactions if you are using the NDS package. Entities put or deleted in
+// the transaction are locked in the cache until it has committed. Unlike
+// datastore.RunInTransaction, later gets within the same transaction see those
+// puts and deletes.
+func RunInTransaction(c context.Context, f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	return defaultClient.RunInTransaction(c, f, opts)
+}
+
+// RunInTransaction works like the package level RunInTransaction using the
+// Client's Options. Puts and deletes within the transaction are locked using
+// the Client's Options even if they are made with another Client or the
+// package level functions.
+func (cl *Client) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	var txc *txContext
+	err := datastoreBackend.RunInTransaction(c, func(
+		tc context.Context) error {
+		txc = &txContext{
+			client:   cl,
+			entities: map[string]txEntity{},
+		}
+		if err := f(context.WithValue(tc, transactionContextKey,
+			txc)); err != nil {
+			return err
+		}
+		return cache.SetMulti(tc, append(cl.legacyLockItems(txc.lockKeys),
+			txc.lockMemcacheItems...))
+	}, opts)
+
+	if txc == nil {
+		return err
+	}
+
+	memcacheKeys := make([]string, len(txc.lockMemcacheItems))
+	for i, item := range txc.lockMemcacheItems {
+		memcacheKeys[i] = item.Key
+	}
+
+	// Evict regardless of err as the transaction may have committed even if
+	// an error was returned.
+	if lc, ok := localCacheContext(c); ok {
+		lc.evict(cl.localCacheKeys(txc.lockKeys))
+	}
+
+	// Entities may have been cached under a new generation during the
+	// transaction. Those items were not locked so they are always removed.
+	// The locks can only be removed once the transaction is known to have
+	// committed. Otherwise they are left to expire.
+	deleteKeys := cl.changedMemcacheKeys(c, txc.lockKeys, memcacheKeys)
+	if err == nil {
+		deleteKeys = append(deleteKeys, memcacheKeys...)
+		deleteKeys = append(deleteKeys, legacyMemcacheKeys(txc.lockKeys)...)
+	}
+	if err := cache.DeleteMulti(c, deleteKeys); err != nil {
+		logger.Warningf(c, "nds:RunInTransaction DeleteMulti %s", err)
+	}
+
+	hooks := txc.rollbackHooks
+	if err == nil {
+		hooks = txc.commitHooks
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	return err
+}
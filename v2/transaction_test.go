@@ -0,0 +1,305 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/v2"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestTransactionOptions(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	opts := &datastore.TransactionOptions{XG: true}
+	err = nds.RunInTransaction(c, func(tc context.Context) error {
+		for i := 0; i < 4; i++ {
+			key := datastore.NewIncompleteKey(tc, "Entity", nil)
+			if _, err := nds.Put(tc, key, &testEntity{i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, opts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts = &datastore.TransactionOptions{XG: false}
+	err = nds.RunInTransaction(c, func(tc context.Context) error {
+		for i := 0; i < 4; i++ {
+			key := datastore.NewIncompleteKey(tc, "Entity", nil)
+			if _, err := nds.Put(tc, key, &testEntity{i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, opts)
+
+	if err == nil {
+		t.Fatal("expected cross-group error")
+	}
+
+}
+
+func TestTransactionReleasesLocks(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{1})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(c, key)
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected lock to be released", err)
+	}
+
+	// The entity can be cached straight away.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item", item.Flags)
+	}
+}
+
+func TestTransactionReadYourWrites(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+		datastore.NewKey(c, "Entity", "", 3, parent),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, keys[0], &testEntity{10}); err != nil {
+			return err
+		}
+		if err := nds.Delete(tc, keys[1]); err != nil {
+			return err
+		}
+		incompleteKey, err := nds.Put(tc,
+			datastore.NewIncompleteKey(tc, "Entity", parent), &testEntity{4})
+		if err != nil {
+			return err
+		}
+
+		entities := make([]testEntity, len(keys)+1)
+		err = nds.GetMulti(tc, append(keys, incompleteKey), entities)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return errors.New("expected MultiError")
+		}
+		expectedErrs := []error{nil, datastore.ErrNoSuchEntity, nil, nil}
+		expectedVals := []int{10, 0, 3, 4}
+		for i, e := range entities {
+			if me[i] != expectedErrs[i] {
+				return fmt.Errorf("expected error %v got %v",
+					expectedErrs[i], me[i])
+			}
+			if e.Val != expectedVals[i] {
+				return fmt.Errorf("expected %d got %d", expectedVals[i], e.Val)
+			}
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionReadYourWritesTimes(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Time time.Time
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	local := time.FixedZone("Local", 3600)
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		entity := &testEntity{time.Unix(1, 123456789).In(local)}
+		if _, err := nds.Put(tc, key, entity); err != nil {
+			return err
+		}
+
+		// The buffered entity matches the one the datastore would return.
+		if err := nds.Get(tc, key, entity); err != nil {
+			return err
+		}
+		if expected := time.Unix(1, 123456000).UTC(); entity.Time != expected {
+			return fmt.Errorf("expected %v got %v", expected, entity.Time)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionHooks(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts, commits, rollbacks := 0, []int{}, []int{}
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		attempts++
+		attempt := attempts
+		if err := nds.OnCommit(tc, func() {
+			commits = append(commits, attempt)
+		}); err != nil {
+			return err
+		}
+		if err := nds.OnRollback(tc, func() {
+			rollbacks = append(rollbacks, attempt)
+		}); err != nil {
+			return err
+		}
+
+		if err := nds.Get(tc, key, &testEntity{}); err != nil {
+			return err
+		}
+
+		// Force the first attempt to be retried by writing to the entity
+		// outside of the transaction.
+		if attempt == 1 {
+			if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+				return err
+			}
+		}
+		_, err := nds.Put(tc, key, &testEntity{3})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 2 {
+		t.Fatal("expected 2 attempts", attempts)
+	}
+	if len(commits) != 1 || commits[0] != 2 {
+		t.Fatal("expected commit hook of final attempt", commits)
+	}
+	if len(rollbacks) != 0 {
+		t.Fatal("expected no rollback hooks", rollbacks)
+	}
+
+	// Rollback.
+	expectedErr := errors.New("expected error")
+	commits, rollbacks = []int{}, []int{}
+	err = nds.RunInTransaction(c, func(tc context.Context) error {
+		nds.OnCommit(tc, func() { commits = append(commits, 1) })
+		nds.OnRollback(tc, func() { rollbacks = append(rollbacks, 1) })
+		return expectedErr
+	}, nil)
+	if err != expectedErr {
+		t.Fatal("expected error", err)
+	}
+	if len(commits) != 0 || len(rollbacks) != 1 {
+		t.Fatal("expected only rollback hook", commits, rollbacks)
+	}
+
+	if err := nds.OnCommit(c, func() {}); err == nil {
+		t.Fatal("expected error outside of transaction")
+	}
+}
+
+func TestTransactionDerivedContext(t *testing.T) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	committed := false
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		dc, cancel := context.WithCancel(tc)
+		defer cancel()
+
+		if err := nds.OnCommit(dc, func() { committed = true }); err != nil {
+			return err
+		}
+		if _, err := nds.Put(dc, key, &testEntity{1}); err != nil {
+			return err
+		}
+
+		te := &testEntity{}
+		if err := nds.Get(dc, key, te); err != nil {
+			return err
+		}
+		if te.Val != 1 {
+			return fmt.Errorf("expected written entity %d", te.Val)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !committed {
+		t.Fatal("expected commit hook")
+	}
+}
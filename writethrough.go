@@ -0,0 +1,177 @@
+package nds
+
+import (
+	"bytes"
+	"reflect"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// SetWriteThrough enables or disables write-through caching for the package
+// level functions. When enabled, a successful non-transactional put replaces
+// the lock it set on each entity with the newly put entity, so the next get is
+// served from the cache instead of the datastore. The swap only happens if the
+// lock has not been changed by another request in the meantime, otherwise the
+// lock is removed as usual. Write-through is disabled by default. Clients use
+// the WriteThrough field of their Options.
+//
+// It is not safe to call SetWriteThrough concurrently with other nds
+// functions so it should be called once during app initialisation.
+func SetWriteThrough(enabled bool) {
+	defaultClient.opts.WriteThrough = enabled
+}
+
+// SetCacheNewEntities enables or disables caching of entities put with
+// incomplete keys by the package level functions. When enabled, each entity is
+// added to the cache under the key the datastore allocated for it. This is
+// safe because no other request can have seen the key before the put returned.
+// Caching new entities is disabled by default. Clients use the
+// CacheNewEntities field of their Options.
+//
+// It is not safe to call SetCacheNewEntities concurrently with other nds
+// functions so it should be called once during app initialisation.
+func SetCacheNewEntities(enabled bool) {
+	defaultClient.opts.CacheNewEntities = enabled
+}
+
+// marshalValue marshals val, a valid element of a PutMulti vals slice, in the
+// format it is cached in.
+func (cl *Client) marshalValue(val reflect.Value) ([]byte, uint32, error) {
+	pl := datastore.PropertyList{}
+	if err := saveValue(val, &pl); err != nil {
+		return nil, 0, err
+	}
+	return cl.marshalEntity(pl)
+}
+
+// addNewEntities adds the entities in vals that were put with incomplete keys
+// to the cache. keys are the keys that were put, dsKeys are the keys returned
+// by the datastore and gens are the generations keys were locked with.
+func (cl *Client) addNewEntities(c appengine.Context, gens generations,
+	keys, dsKeys []*datastore.Key, vals interface{}) {
+
+	v := reflect.ValueOf(vals)
+	addItems := []*Item{}
+	chunkItems := []*Item{}
+	for i, key := range keys {
+		if !key.Incomplete() {
+			continue
+		}
+
+		policy := cl.kindPolicy(key.Kind())
+		if policy.NoCache {
+			continue
+		}
+
+		value, flags, err := cl.marshalValue(v.Index(i))
+		if err != nil {
+			c.Warningf("nds:addNewEntities marshalValue %s", err)
+			continue
+		}
+
+		item := &Item{
+			Key:        cl.createMemcacheKey(gens, dsKeys[i]),
+			Value:      value,
+			Flags:      flags,
+			Expiration: policy.Expiration,
+		}
+		if len(item.Value) > memcacheMaxItemSize {
+			chunkItems = append(chunkItems, splitItem(item)...)
+		}
+		addItems = append(addItems, item)
+	}
+
+	addItems = saveChunks(c, "nds:addNewEntities", addItems, chunkItems)
+
+	if err := cache.AddMulti(c, addItems); err != nil {
+		c.Warningf("nds:addNewEntities AddMulti %s", err)
+	}
+}
+
+// writeThroughMemcache swaps the lockMemcacheItems set by putMulti for the
+// entities in vals. keys and vals are the arguments that were put and
+// lockMemcacheItems holds a lock for each complete key in keys, in order. It
+// returns the keys of the locks that were not swapped and so still need to be
+// removed.
+func (cl *Client) writeThroughMemcache(c appengine.Context,
+	keys []*datastore.Key, vals interface{},
+	lockMemcacheItems []*Item) []string {
+
+	lockMemcacheKeys := make([]string, len(lockMemcacheItems))
+	keyCounts := make(map[string]int, len(lockMemcacheItems))
+	for i, item := range lockMemcacheItems {
+		lockMemcacheKeys[i] = item.Key
+		keyCounts[item.Key]++
+	}
+
+	items, err := cache.GetMulti(c, lockMemcacheKeys)
+	if err != nil {
+		c.Warningf("nds:writeThroughMemcache GetMulti %s", err)
+		return lockMemcacheKeys
+	}
+
+	v := reflect.ValueOf(vals)
+	swapItems := make([]*Item, 0, len(lockMemcacheItems))
+	chunkItems := []*Item{}
+	lockIndex := 0
+	for i, key := range keys {
+		if key.Incomplete() {
+			continue
+		}
+		lock := lockMemcacheItems[lockIndex]
+		lockIndex++
+
+		// It is not known which of a key's duplicate vals the datastore kept.
+		policy := cl.kindPolicy(key.Kind())
+		if policy.NoCache || keyCounts[lock.Key] > 1 {
+			continue
+		}
+
+		// Only replace the lock if it is still the one we set.
+		item, ok := items[lock.Key]
+		if !ok || item.Flags != lock.Flags ||
+			!bytes.Equal(item.Value, lock.Value) {
+			continue
+		}
+
+		value, flags, err := cl.marshalValue(v.Index(i))
+		if err != nil {
+			c.Warningf("nds:writeThroughMemcache marshalValue %s", err)
+			continue
+		}
+
+		item.Value = value
+		item.Flags = flags
+		item.Expiration = policy.Expiration
+		if len(item.Value) > memcacheMaxItemSize {
+			chunkItems = append(chunkItems, splitItem(item)...)
+		}
+		swapItems = append(swapItems, item)
+	}
+
+	swapItems = saveChunks(c, "nds:writeThroughMemcache", swapItems, chunkItems)
+
+	swapped := make(map[string]bool, len(swapItems))
+	if err := cache.CompareAndSwapMulti(c, swapItems); err == nil {
+		for _, item := range swapItems {
+			swapped[item.Key] = true
+		}
+	} else if me, ok := err.(appengine.MultiError); ok {
+		for i, item := range swapItems {
+			if me[i] == nil {
+				swapped[item.Key] = true
+			}
+		}
+	} else {
+		c.Warningf("nds:writeThroughMemcache CompareAndSwapMulti %s", err)
+	}
+
+	unswappedKeys := make([]string, 0, len(lockMemcacheKeys)-len(swapped))
+	for _, key := range lockMemcacheKeys {
+		if !swapped[key] {
+			unswappedKeys = append(unswappedKeys, key)
+		}
+	}
+	return unswappedKeys
+}
@@ -0,0 +1,249 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func TestWriteThrough(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetWriteThrough(true)
+	defer nds.SetWriteThrough(false)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "WriteThrough", "", 1, nil),
+		datastore.NewKey(c, "WriteThrough", "", 2, nil),
+	}
+	entities := []testEntity{{1}, {2}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		item, err := memcache.Get(c, nds.CreateMemcacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Flags != nds.EntityItem {
+			t.Fatal("expected entity item", item.Flags)
+		}
+	}
+
+	nds.SetDatastoreGetMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) != 0 {
+			return errors.New("should not be called")
+		}
+		return nil
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	getEntities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, getEntities); err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entities {
+		if e != getEntities[i] {
+			t.Fatal("expected", e, "got", getEntities[i])
+		}
+	}
+}
+
+func TestWriteThroughLockChanged(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetWriteThrough(true)
+	defer nds.SetWriteThrough(false)
+
+	key := datastore.NewKey(c, "WriteThrough", "", 1, nil)
+	memcacheKey := nds.CreateMemcacheKey(c, key)
+
+	// Simulate another request locking the entity while it is being put.
+	nds.SetDatastorePutMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:   memcacheKey,
+			Flags: nds.LockItem,
+			Value: []byte{1, 2, 3, 4, 5},
+		}); err != nil {
+			return nil, err
+		}
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected cache miss", err)
+	}
+}
+
+func TestWriteThroughNoCache(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetWriteThrough(true)
+	defer nds.SetWriteThrough(false)
+
+	nds.SetKindPolicy("WriteThroughNoCache", nds.Policy{NoCache: true})
+	defer nds.SetKindPolicy("WriteThroughNoCache", nds.Policy{})
+
+	key := datastore.NewKey(c, "WriteThroughNoCache", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = memcache.Get(c, nds.CreateMemcacheKey(c, key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatal("expected cache miss", err)
+	}
+}
+
+func TestCacheNewEntities(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetCacheNewEntities(true)
+	defer nds.SetCacheNewEntities(false)
+
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "NewEntity", nil),
+		datastore.NewKey(c, "NewEntity", "", 100, nil),
+		datastore.NewIncompleteKey(c, "NewEntity", nil),
+	}
+	entities := []testEntity{{1}, {2}, {3}}
+	keys, err = nds.PutMulti(c, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the entities put with incomplete keys are cached.
+	cached := []bool{true, false, true}
+	for i, key := range keys {
+		item, err := memcache.Get(c, nds.CreateMemcacheKey(c, key))
+		if !cached[i] {
+			if err != memcache.ErrCacheMiss {
+				t.Fatal("expected cache miss", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Flags != nds.EntityItem {
+			t.Fatal("expected entity item", item.Flags)
+		}
+	}
+
+	nds.SetDatastoreGetMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) != 0 {
+			return errors.New("should not be called")
+		}
+		return nil
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	getKeys := []*datastore.Key{keys[0], keys[2]}
+	getEntities := make([]testEntity, len(getKeys))
+	if err := nds.GetMulti(c, getKeys, getEntities); err != nil {
+		t.Fatal(err)
+	}
+	if getEntities[0].IntVal != 1 || getEntities[1].IntVal != 3 {
+		t.Fatal("incorrect entities", getEntities)
+	}
+}
+
+func TestWriteThroughNormalizesTimes(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type testEntity struct {
+		Time time.Time
+	}
+
+	nds.SetWriteThrough(true)
+	defer nds.SetWriteThrough(false)
+	nds.SetCacheNewEntities(true)
+	defer nds.SetCacheNewEntities(false)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "NormalizeTimes", "complete", 0, nil),
+		datastore.NewIncompleteKey(c, "NormalizeTimes", nil),
+	}
+	local := time.FixedZone("Local", 3600)
+	entities := []testEntity{
+		{time.Unix(1, 123456789).In(local)},
+		{time.Unix(2, 123456789).In(local)},
+	}
+	keys, err = nds.PutMulti(c, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetDatastoreGetMulti(func(c appengine.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) != 0 {
+			return errors.New("should not be called")
+		}
+		return nil
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	// Cached times match those the datastore would return.
+	getEntities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, getEntities); err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range getEntities {
+		expected := time.Unix(int64(i+1), 123456000).UTC()
+		if e.Time != expected {
+			t.Fatal("expected", expected, "got", e.Time)
+		}
+	}
+}